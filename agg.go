@@ -1,8 +1,11 @@
 package agg
 
 import (
+	"context"
+	"fmt"
 	"strings"
-	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jinzhu/copier"
 	"github.com/timdrysdale/hub"
@@ -20,12 +23,40 @@ func New() *Hub {
 		Rules:      make(map[string][]string),
 		Add:        make(chan Rule),
 		Delete:     make(chan string),
+
+		rules:            make(map[string]Rule),
+		options:          make(map[*hub.Client]ClientOptions),
+		counters:         make(map[*hub.Client]*relayCounters),
+		feeds:            make(map[string]map[*hub.Client]bool),
+		joined:           make(map[*hub.Client]map[string]int),
+		muxers:           make(map[*hub.Client]*muxer),
+		relaying:         make(map[string]map[*SubClient]bool),
+		limiters:         make(map[*hub.Client]map[RateLimit]*limiter),
+		feedCounters:     make(map[string]map[string]*relayCounters),
+		subscribers:      make(map[*subscriber]bool),
+		mutes:            make(map[string]map[string]*mute),
+		schedules:        make(map[string]Schedule),
+		overrides:        make(map[string]*override),
+		ruleRequests:     make(chan ruleRequest),
+		registerRequests: make(chan registerRequest),
+		snapshotRequests: make(chan snapshotRequest),
+		statsRequests:    make(chan statsRequest),
+		subscriptions:    make(chan subscribeRequest),
+		muteRequests:     make(chan muteRequest),
+		muteExpiries:     make(chan muteExpiry),
+		scheduleRequests: make(chan scheduleRequest),
+		scheduleTicks:    make(chan struct{}),
+		evictions:        make(chan eviction),
+		done:             make(chan struct{}),
+		running:          new(int64),
 	}
 
 	return h
 
 }
 
+// Run runs the hub until closed is closed. If Store is set and the
+// stored rules cannot be loaded, it returns at once; Err gives the cause.
 func (h *Hub) Run(closed chan struct{}) {
 	h.RunOptionalStats(closed, false)
 }
@@ -36,147 +67,466 @@ func (h *Hub) RunWithStats(closed chan struct{}) {
 
 func (h *Hub) RunOptionalStats(closed chan struct{}, withStats bool) {
 
-	//start the hub
-	if withStats {
-		go h.Hub.RunWithStats(closed)
-	} else {
-		go h.Hub.Run(closed)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	h.run(ctx, withStats)
+}
+
+// Err returns the error that stopped the hub, which is nil unless it
+// stopped because the stored rules could not be loaded. It is only set
+// once the hub has stopped.
+func (h *Hub) Err() error {
+
+	select {
+	case <-h.done:
+		return h.err
+	default:
+		return nil
+	}
+}
+
+// stopped returns the error for a request the hub cannot service
+// because it has stopped, giving the cause if there was one
+func (h *Hub) stopped() error {
+
+	if err := h.Err(); err != nil {
+		return fmt.Errorf("%w: %w", ErrHubClosed, err)
+	}
+
+	return ErrHubClosed
+}
+
+// RunContext runs the hub until ctx is cancelled. Before returning, it
+// unregisters every subclient, stops every relay and the inner hub, and
+// waits for all the goroutines it started to exit. A hub cannot be run
+// again after it has stopped. If Store is set, the stored rules are
+// loaded first, and an error is returned if they cannot be.
+func (h *Hub) RunContext(ctx context.Context) error {
+	return h.run(ctx, false)
+}
+
+// RunContextWithStats is RunContext with statistics enabled on the inner hub
+func (h *Hub) RunContextWithStats(ctx context.Context) error {
+	return h.run(ctx, true)
+}
+
+func (h *Hub) run(ctx context.Context, withStats bool) error {
+
+	// let synchronous callers know we are no longer servicing requests
+	defer close(h.done)
+
+	//start the hub, with its own closed channel so that it keeps
+	//running while we unregister our subclients from it
+	hubClosed := make(chan struct{})
+	hubStopped := make(chan struct{})
+
+	go func() {
+		defer close(hubStopped)
+		if withStats {
+			h.Hub.RunWithStats(hubClosed)
+		} else {
+			h.Hub.Run(hubClosed)
+		}
+	}()
+
+	defer func() {
+		h.teardown()
+		close(hubClosed)
+		<-hubStopped
+		h.relays.Wait()
+	}()
+
+	if err := h.loadRules(); err != nil {
+		h.err = err
+		return err
 	}
 
 	for {
 		select {
-		case <-closed:
-			return
+		case <-ctx.Done():
+			return nil
 		case client := <-h.Register:
-			if strings.HasPrefix(client.Topic, "stream/") {
-				// register the client to the stream
-				if _, ok := h.Streams[client.Topic]; !ok {
-					h.Streams[client.Topic] = make(map[*hub.Client]bool)
-				}
-				h.Streams[client.Topic][client] = true
-
-				// register the client to any feeds currently set by stream rule
-				if feeds, ok := h.Rules[client.Topic]; ok {
-					h.SubClients[client] = make(map[*SubClient]bool)
-					wg := &sync.WaitGroup{}
-					for _, feed := range feeds {
-						// create and store the subclients we will register with the hub
-						subClient := &SubClient{Client: &hub.Client{}}
-						copier.Copy(&subClient.Client, client)
-						subClient.Client.Topic = feed
-						subClient.Client.Send = make(chan hub.Message)
-						subClient.Stopped = make(chan struct{})
-						h.SubClients[client][subClient] = true
-						wg.Add(1)
-						go subClient.RelayTo(client)
-						h.Hub.Register <- subClient.Client
-					}
-
-				}
+			if strings.HasPrefix(client.Topic, streamPrefix) {
+				h.joinStream(client, client.Topic)
 			} else {
-				// register client directly
-				h.Hub.Register <- client
+				h.registerFeed(client)
 			}
 		case client := <-h.Unregister:
-			if strings.HasPrefix(client.Topic, "stream/") {
-				// unregister any subclients that are registered to feeds
-				for subClient := range h.SubClients[client] {
-					h.Hub.Unregister <- subClient.Client
-					close(subClient.Stopped)
-				}
-
-				// delete the client from the stream
-				if _, ok := h.Streams[client.Topic]; ok {
-					delete(h.Streams[client.Topic], client)
-					//close(client.Send)
-				}
-				delete(h.SubClients, client)
-
+			if strings.HasPrefix(client.Topic, streamPrefix) {
+				h.leaveStream(client, client.Topic)
 			} else {
-				// unregister client directly
-				h.Hub.Unregister <- client
+				h.unregisterFeed(client)
+			}
+		case req := <-h.registerRequests:
+			h.handleRegister(req)
+		case e := <-h.evictions:
+			// the relay may have been stopped since it asked
+			if !h.SubClients[e.client][e.subClient] {
+				break
 			}
+			if e.lost {
+				h.restartFeed(e.client, e.subClient)
+				break
+			}
+			h.removeClient(e.client)
+			close(e.client.Send)
 		case msg := <-h.Broadcast:
+			if rule, ok := h.rules[msg.Sender.Topic]; ok && len(rule.Return) > 0 {
+				h.broadcastReturn(msg, rule)
+				break
+			}
+			h.cache(msg)
+			h.offer(msg)
 			// defer handling to hub
 			// note that non-responsive clients will get deleted
 			h.Hub.Broadcast <- msg
 		case rule := <-h.Add:
-			if rule.Stream == "deleteAll" {
-				break //reserved ID for deleting all rules
-			}
-			// unregister clients from old feeds, if any
-			if _, ok := h.Rules[rule.Stream]; ok {
-				for client, _ := range h.Streams[rule.Stream] {
-					for subClient := range h.SubClients[client] {
-						h.Hub.Unregister <- subClient.Client
-						close(subClient.Stopped)
-					}
-				}
-			}
-			//set new rule
-			h.Rules[rule.Stream] = rule.Feeds
-			// register the clients to any feeds currently set by stream rule
-			if feeds, ok := h.Rules[rule.Stream]; ok {
-				for client, _ := range h.Streams[rule.Stream] {
-					h.SubClients[client] = make(map[*SubClient]bool)
-					for _, feed := range feeds {
-						// create and store the subclients we will register with the hub
-						subClient := &SubClient{Client: &hub.Client{}}
-						copier.Copy(&subClient.Client, client)
-						subClient.Client.Topic = feed
-						subClient.Client.Send = make(chan hub.Message)
-						subClient.Stopped = make(chan struct{})
-						h.SubClients[client][subClient] = true
-						go subClient.RelayTo(client)
-						h.Hub.Register <- subClient.Client
-					}
-				}
+			// invalid rules are ignored; use AddRule to find out why
+			h.persist(h.addRule(rule))
+		case stream := <-h.Delete:
+			if stream == DeleteAll {
+				h.deleteAllRules()
+				h.persist(nil)
+			} else {
+				h.persist(h.deleteRule(stream))
 			}
+		case req := <-h.ruleRequests:
+			req.result <- h.persist(h.handleRuleRequest(req))
+		case req := <-h.snapshotRequests:
+			req.result <- h.snapshot()
+		case req := <-h.statsRequests:
+			req.result <- h.stats()
+		case req := <-h.subscriptions:
+			h.handleSubscribe(req)
+		case req := <-h.muteRequests:
+			h.handleMute(req)
+		case e := <-h.muteExpiries:
+			h.handleMuteExpiry(e)
+		case req := <-h.scheduleRequests:
+			h.handleSchedule(req)
+		case <-h.scheduleTicks:
+			h.emitSkipped(h.applySchedules())
+		}
+	}
+}
 
-		case stream := <-h.Delete:
+// joinStream registers a client to a stream, and to any feeds the
+// stream's rule currently sets that the client does not already have
+// from another stream. Each registration to the same stream must be
+// matched by one to leaveStream.
+func (h *Hub) joinStream(client *hub.Client, stream string) {
+
+	if _, ok := h.joined[client]; !ok {
+		h.joined[client] = make(map[string]int)
+	}
+	if _, ok := h.counters[client]; !ok {
+		h.counters[client] = &relayCounters{since: time.Now()}
+	}
 
-			if stream == "deleteAll" { //all streams to be deleted
+	h.joined[client][stream]++
 
-				for _, client := range h.SubClients {
-					for subclient := range client { //h.SubClients[client] {
-						h.Hub.Unregister <- subclient.Client
-						close(subclient.Stopped)
-					}
-				}
+	if h.joined[client][stream] == 1 {
+		if _, ok := h.Streams[stream]; !ok {
+			h.Streams[stream] = make(map[*hub.Client]bool)
+		}
+		h.Streams[stream][client] = true
+		h.emitClient(StreamClientJoined, client, stream, "")
 
-				h.Rules = make(map[string][]string)
+		// the feeds that are new to the client are replayed
+		h.joining = make(map[string]bool)
+		for subClient := range h.SubClients[client] {
+			h.joining[subClient.Client.Topic] = true
+		}
+		defer func() { h.joining = nil }()
+	}
 
-			} else { //single stream
+	// the options may have changed, even if the client was already here
+	h.refresh(client)
+}
 
-				// unregister clients from old feeds, if any
-				if _, ok := h.Rules[stream]; ok {
-					for client, _ := range h.Streams[stream] {
-						for subClient := range h.SubClients[client] {
-							h.Hub.Unregister <- subClient.Client
-							close(subClient.Stopped)
-						}
-					}
-				}
+// leaveStream undoes one registration of a client to a stream. Once
+// the last is undone, the client is removed from the stream, and from
+// any feeds that none of its other streams need.
+func (h *Hub) leaveStream(client *hub.Client, stream string) {
 
-				// delete rule
-				delete(h.Rules, stream)
-			}
-		}
+	n := h.joined[client][stream]
+
+	if n == 0 {
+		return
+	}
+
+	if n > 1 {
+		h.joined[client][stream]--
+		return
 	}
+
+	delete(h.joined[client], stream)
+	delete(h.Streams[stream], client)
+
+	if len(h.joined[client]) == 0 {
+		h.detach(client)
+		h.forget(client)
+	} else {
+		h.refresh(client)
+	}
+
+	h.emitClient(StreamClientLeft, client, stream, "")
+	h.pruneStats(stream)
 }
 
-// relay messages from subClient to Client
-func (sc *SubClient) RelayTo(c *hub.Client) {
-	for {
-		select {
-		case <-sc.Stopped:
-			return
-		case msg, ok := <-sc.Client.Send:
-			if ok {
-				c.Send <- msg
-			} else {
-				return
-			}
+// removeClient removes a client from all of its streams at once
+func (h *Hub) removeClient(client *hub.Client) {
+
+	h.detach(client)
+
+	streams := h.joined[client]
+	h.forget(client)
+
+	for stream := range streams {
+		delete(h.Streams[stream], client)
+		h.emitClient(StreamClientLeft, client, stream, "")
+		h.pruneStats(stream)
+	}
+}
+
+// forget deletes what is known about a client that is in no streams
+func (h *Hub) forget(client *hub.Client) {
+	delete(h.joined, client)
+	delete(h.SubClients, client)
+	delete(h.options, client)
+	delete(h.counters, client)
+	delete(h.muxers, client)
+	delete(h.limiters, client)
+}
+
+// addRule sets the rule for a stream, replacing any existing rule,
+// and moves the clients of the stream, and of any streams containing
+// it, onto the new feeds, leaving feeds in both rules untouched
+func (h *Hub) addRule(rule Rule) error {
+
+	if err := validateRule(rule); err != nil {
+		return err
+	}
+
+	if err := h.checkCycle(rule); err != nil {
+		return err
+	}
+
+	rule.Version = h.nextVersion()
+
+	if _, ok := h.rules[rule.Stream]; ok {
+		h.emitRule(RuleReplaced, rule)
+	} else {
+		h.emitRule(RuleAdded, rule)
+	}
+
+	//set new rule
+	h.rules[rule.Stream] = rule
+	h.Rules[rule.Stream] = rule.Feeds
+
+	for _, stream := range h.dependents(rule.Stream) {
+		h.reattach(stream)
+	}
+
+	return nil
+}
+
+// deleteRule removes the rule for a single stream, leaving the
+// stream's clients registered to the stream but not to any feeds
+func (h *Hub) deleteRule(stream string) error {
+
+	if err := validateStream(stream); err != nil {
+		return err
+	}
+
+	rule, ok := h.rules[stream]
+	if !ok {
+		return nil
+	}
+
+	h.emitRule(RuleDeleted, rule)
+
+	// delete rule
+	delete(h.rules, stream)
+	delete(h.Rules, stream)
+	h.pruneStats(stream)
+
+	// unregister clients from old feeds, including
+	// those of any streams that contained this one
+	for _, s := range h.dependents(stream) {
+		h.reattach(s)
+	}
+
+	return nil
+}
+
+// deleteAllRules removes every rule, leaving stream clients
+// registered to their streams but not to any feeds
+func (h *Hub) deleteAllRules() {
+
+	for client := range h.SubClients {
+		h.detach(client)
+	}
+
+	for _, rule := range h.rules {
+		h.emitRule(RuleDeleted, rule)
+	}
+
+	h.rules = make(map[string]Rule)
+	h.Rules = make(map[string][]string)
+	h.invalidateReplays()
+
+	for stream := range h.feedCounters {
+		h.pruneStats(stream)
+	}
+}
+
+// policyFor returns the relay policy for a stream client's feeds. The
+// client's own policy takes precedence over the rule's.
+func (h *Hub) policyFor(client *hub.Client, rule Rule) RelayPolicy {
+
+	if p := h.options[client].Policy; p != nil {
+		return *p
+	}
+
+	if rule.Policy != nil {
+		return *rule.Policy
+	}
+
+	return RelayPolicy{}
+}
+
+// attachFeed relays a single feed to a stream client, counting it
+// against the stream whose rule is given
+func (h *Hub) attachFeed(client *hub.Client, rule Rule, feed string) {
+
+	policy := h.policyFor(client, rule)
+
+	if _, ok := h.SubClients[client]; !ok {
+		h.SubClients[client] = make(map[*SubClient]bool)
+	}
+
+	// create and store the subclient we will register with the hub
+	subClient := &SubClient{Client: &hub.Client{}}
+	copier.Copy(&subClient.Client, client)
+	subClient.Client.Topic = feed
+	// the inner hub drops a subclient that is not ready for a message,
+	// so give the relay room to fall behind while it works
+	size := policy.Size
+	if size == 0 {
+		size = DefaultRelayBuffer
+	}
+	subClient.Client.Send = make(chan hub.Message, size)
+	subClient.Stopped = make(chan struct{})
+	subClient.Policy = policy
+	subClient.counters = h.counters[client]
+	subClient.stream = rule.Stream
+	subClient.tagged = h.options[client].Tagged
+	subClient.setFilters(filtersFor(rule, feed))
+	subClient.setTransforms(transformsFor(rule, feed))
+	subClient.limit = h.limitFor(client, rule)
+	subClient.limiter = h.limiterFor(client, subClient.limit)
+	if rule.Mux {
+		subClient.mux = h.muxerFor(client)
+		subClient.mux.add(feed)
+	}
+	subClient.feedCounters = h.countersFor(rule.Stream, feed)
+	subClient.evict = h.evictions
+	if h.joining != nil && !h.joining[feed] {
+		subClient.replay = h.replayFor(rule.Stream, feed)
+	}
+	subClient.exited = make(chan struct{})
+	h.SubClients[client][subClient] = true
+	if _, ok := h.relaying[feed]; !ok {
+		h.relaying[feed] = make(map[*SubClient]bool)
+	}
+	h.relaying[feed][subClient] = true
+	h.relays.Add(1)
+	atomic.AddInt64(h.running, 1)
+	go func() {
+		defer h.relays.Done()
+		defer close(subClient.exited)
+		defer atomic.AddInt64(h.running, -1)
+		subClient.RelayTo(client)
+	}()
+	h.Hub.Register <- subClient.Client
+	h.emitClient(FeedAttached, client, rule.Stream, feed)
+}
+
+// detach unregisters all the subclients of a stream client from
+// the hub, and waits for their relays to stop
+func (h *Hub) detach(client *hub.Client) {
+
+	for subClient := range h.SubClients[client] {
+		h.detachFeed(client, subClient)
+	}
+}
+
+// detachFeed stops relaying a single feed to a stream client
+func (h *Hub) detachFeed(client *hub.Client, subClient *SubClient) {
+
+	h.Hub.Unregister <- subClient.Client
+	close(subClient.Stopped)
+	<-subClient.exited
+	if subClient.mux != nil {
+		subClient.mux.remove(subClient.Client.Topic)
+	}
+	delete(h.SubClients[client], subClient)
+	delete(h.relaying[subClient.Client.Topic], subClient)
+	if len(h.relaying[subClient.Client.Topic]) == 0 {
+		delete(h.relaying, subClient.Client.Topic)
+	}
+	h.emitClient(FeedDetached, client, subClient.stream, subClient.Client.Topic)
+}
+
+// restartFeed replaces a relay whose subclient the inner hub dropped,
+// counting the messages it never received as dropped
+func (h *Hub) restartFeed(client *hub.Client, subClient *SubClient) {
+
+	h.detachFeed(client, subClient)
+	subClient.dropped(subClient.offered - subClient.received)
+	h.refresh(client)
+}
+
+// offer counts a message about to be broadcast by the inner hub against
+// each subclient it will be sent to; the hub does not send a client
+// its own messages
+func (h *Hub) offer(msg hub.Message) {
+
+	for subClient := range h.relaying[msg.Sender.Topic] {
+		if subClient.Client.Name != msg.Sender.Name {
+			subClient.offered++
 		}
 	}
 }
+
+// teardown detaches every stream client and forgets the streams, so
+// that no relays remain once the run loop has stopped
+func (h *Hub) teardown() {
+
+	for client := range h.SubClients {
+		h.detach(client)
+	}
+
+	h.SubClients = make(map[*hub.Client]map[*SubClient]bool)
+	h.Streams = make(map[string]map[*hub.Client]bool)
+	h.joined = make(map[*hub.Client]map[string]int)
+	h.muxers = make(map[*hub.Client]*muxer)
+	h.relaying = make(map[string]map[*SubClient]bool)
+	h.limiters = make(map[*hub.Client]map[RateLimit]*limiter)
+	h.options = make(map[*hub.Client]ClientOptions)
+	h.counters = make(map[*hub.Client]*relayCounters)
+	h.feeds = make(map[string]map[*hub.Client]bool)
+	h.stopMutes()
+	h.stopSchedules()
+	h.closeSubscribers()
+}
@@ -2,6 +2,7 @@ package agg
 
 import (
 	"bytes"
+	"context"
 	"reflect"
 	"testing"
 	"time"
@@ -724,3 +725,57 @@ func TestStreamWithRuleChange(t *testing.T) {
 		t.Error("Did not get message from c3")
 	}
 }
+
+func TestRunContextTearsDown(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() {
+		stopped <- h.RunContext(ctx)
+	}()
+
+	stream := "stream/large"
+	feeds := []string{"video0", "audio"}
+
+	if err := h.AddRule(ctx, Rule{Stream: stream, Feeds: feeds}); err != nil {
+		t.Fatal(err)
+	}
+
+	// c never reads its Send channel, so its relay will be blocked
+	c := &hub.Client{Hub: h.Hub, Name: "aa", Topic: stream, Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	h.Register <- c
+
+	c1 := &hub.Client{Hub: h.Hub, Name: "1", Topic: "video0", Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	h.Register <- c1
+
+	time.Sleep(time.Millisecond)
+	h.Broadcast <- hub.Message{Data: []byte{'t'}, Sender: *c1, Sent: time.Now()}
+	time.Sleep(time.Millisecond)
+
+	cancel()
+
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Error("RunContext returned error", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("RunContext did not return after cancellation")
+	}
+
+	// RunContext has returned, so nothing else is touching the hub
+	for _, feed := range feeds {
+		for client := range h.Hub.Clients[feed] {
+			if client.Name == c.Name {
+				t.Error("subclient still registered to", feed)
+			}
+		}
+	}
+	if len(h.SubClients) != 0 || len(h.Streams) != 0 {
+		t.Error("stream client state not cleared")
+	}
+
+	if err := h.AddRule(context.Background(), Rule{Stream: stream, Feeds: feeds}); err != ErrHubClosed {
+		t.Error("wanted ErrHubClosed, got", err)
+	}
+}
@@ -0,0 +1,100 @@
+package agg
+
+import "context"
+
+// Batch is a set of rule changes to make in one go, e.g. to swap the
+// cameras in several streams at once. The deletes are made before the
+// adds, so a stream may be in both to replace its rule from scratch.
+type Batch struct {
+	Add    []Rule   `json:"add,omitempty"`
+	Delete []string `json:"delete,omitempty"`
+}
+
+// ApplyBatch makes every change in the batch, or none of them if any
+// is invalid or the rules would contain a cycle once it was applied.
+// Stream clients are moved straight from their old feeds to their new
+// ones, without seeing the rules part way through the batch. It
+// returns once the changes have taken effect.
+func (h *Hub) ApplyBatch(ctx context.Context, batch Batch) error {
+	return h.requestRule(ctx, ruleRequest{batch: &batch})
+}
+
+// applyBatch is called from the run loop
+func (h *Hub) applyBatch(batch Batch) error {
+
+	for _, stream := range batch.Delete {
+		if err := validateStream(stream); err != nil {
+			return err
+		}
+	}
+
+	for _, rule := range batch.Add {
+		if err := validateRule(rule); err != nil {
+			return err
+		}
+	}
+
+	next := make(map[string]Rule)
+	for stream, rule := range h.rules {
+		next[stream] = rule
+	}
+	for _, stream := range batch.Delete {
+		delete(next, stream)
+	}
+	for _, rule := range batch.Add {
+		next[rule.Stream] = rule
+	}
+
+	// check for cycles against the rules as they will be
+	// once the whole batch is applied
+	current := h.rules
+	h.rules = next
+	for _, rule := range batch.Add {
+		if err := h.checkCycle(rule); err != nil {
+			h.rules = current
+			return err
+		}
+	}
+	h.rules = current
+
+	changed := []string{}
+
+	for _, stream := range batch.Delete {
+		rule, ok := h.rules[stream]
+		if !ok {
+			continue
+		}
+		h.emitRule(RuleDeleted, rule)
+		delete(h.rules, stream)
+		delete(h.Rules, stream)
+		h.pruneStats(stream)
+		changed = append(changed, stream)
+	}
+
+	for _, rule := range batch.Add {
+		rule = rule.copy()
+		rule.Version = h.nextVersion()
+		if _, ok := h.rules[rule.Stream]; ok {
+			h.emitRule(RuleReplaced, rule)
+		} else {
+			h.emitRule(RuleAdded, rule)
+		}
+		h.rules[rule.Stream] = rule
+		h.Rules[rule.Stream] = rule.Feeds
+		changed = append(changed, rule.Stream)
+	}
+
+	// move each affected stream's clients once, now that all
+	// the rules are in place
+	affected := make(map[string]bool)
+	for _, stream := range changed {
+		for _, s := range h.dependents(stream) {
+			if !affected[s] {
+				affected[s] = true
+				h.reattach(s)
+			}
+		}
+	}
+
+	return nil
+}
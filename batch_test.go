@@ -0,0 +1,83 @@
+package agg
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/timdrysdale/hub"
+)
+
+func TestApplyBatch(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	for _, rule := range []Rule{
+		{Stream: "stream/a", Feeds: []string{"video0"}},
+		{Stream: "stream/b", Feeds: []string{"stream/a"}},
+		{Stream: "stream/old", Feeds: []string{"audio"}},
+	} {
+		if err := h.AddRule(ctx, rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &hub.Client{Hub: h.Hub, Name: "aa", Topic: "stream/a", Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	if err := h.RegisterWithOptions(ctx, c, ClientOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the swap is only valid as a whole, because the
+	// first rule on its own would make a cycle
+	swap := Batch{
+		Add: []Rule{
+			{Stream: "stream/a", Feeds: []string{"stream/b"}},
+			{Stream: "stream/b", Feeds: []string{"video1"}},
+		},
+		Delete: []string{"stream/old"},
+	}
+	if err := h.ApplyBatch(ctx, swap); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := h.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Rules["stream/old"]; ok {
+		t.Error("deleted rule still present")
+	}
+	if got := s.Rules["stream/a"].Feeds; !reflect.DeepEqual(got, []string{"stream/b"}) {
+		t.Error("wrong feeds for stream/a", got)
+	}
+	if got := s.Streams["stream/a"][0].Feeds; !reflect.DeepEqual(got, []string{"video1"}) {
+		t.Error("wrong feeds for client", got)
+	}
+
+	// nothing is applied if any change fails
+	bad := Batch{
+		Add: []Rule{
+			{Stream: "stream/c", Feeds: []string{"video2"}},
+			{Stream: "stream/b", Feeds: []string{"stream/a"}},
+		},
+	}
+	if err := h.ApplyBatch(ctx, bad); !errors.Is(err, ErrCycle) {
+		t.Error("wanted ErrCycle, got", err)
+	}
+
+	bad = Batch{Add: []Rule{{Stream: "stream/c", Feeds: []string{"video2"}}}, Delete: []string{DeleteAll}}
+	if err := h.ApplyBatch(ctx, bad); !errors.Is(err, ErrReservedName) {
+		t.Error("wanted ErrReservedName, got", err)
+	}
+
+	after, err := h.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(after.Rules, s.Rules) {
+		t.Error("rules changed by failed batch", after.Rules)
+	}
+}
@@ -0,0 +1,119 @@
+package agg
+
+import (
+	"context"
+	"strings"
+
+	"github.com/timdrysdale/hub"
+)
+
+// ClientOptions are set when a stream client registers, and
+// take precedence over the stream's rule
+type ClientOptions struct {
+	Policy *RelayPolicy
+	// Tagged, if set, receives each message labelled with the feed
+	// and stream it came from, instead of the client's Send channel
+	Tagged chan<- TaggedMessage
+	// Limit, if set, replaces the rate limit in the stream's rule
+	Limit *RateLimit
+}
+
+type registerRequest struct {
+	client  *hub.Client
+	stream  string
+	leave   bool
+	options ClientOptions
+	result  chan error
+}
+
+// RegisterWithOptions registers a client as if sent on Register, and
+// returns once the client has been registered to the stream's feeds.
+// The options only apply to clients whose topic is a stream.
+func (h *Hub) RegisterWithOptions(ctx context.Context, client *hub.Client, options ClientOptions) error {
+
+	if options.Policy != nil {
+		if err := options.Policy.validate(); err != nil {
+			return err
+		}
+	}
+
+	if options.Limit != nil {
+		if err := options.Limit.validate(); err != nil {
+			return err
+		}
+	}
+
+	return h.requestRegister(ctx, registerRequest{client: client, stream: client.Topic, options: options})
+}
+
+// JoinStream registers a client to a stream, whatever the client's own
+// topic, so that one client can receive several streams. A feed that
+// is in more than one of the client's streams is only relayed to it
+// once. The options replace any the client already has, and apply to
+// all its streams. Each call must be matched by one to LeaveStream, or
+// by the client being sent on Unregister if the stream is its topic.
+// It returns once the client has been registered to the stream's feeds.
+func (h *Hub) JoinStream(ctx context.Context, client *hub.Client, stream string, options ClientOptions) error {
+
+	if err := validateStream(stream); err != nil {
+		return err
+	}
+
+	if options.Policy != nil {
+		if err := options.Policy.validate(); err != nil {
+			return err
+		}
+	}
+
+	if options.Limit != nil {
+		if err := options.Limit.validate(); err != nil {
+			return err
+		}
+	}
+
+	return h.requestRegister(ctx, registerRequest{client: client, stream: stream, options: options})
+}
+
+// LeaveStream undoes a registration of a client to a stream. Once each
+// registration has been undone, the client is removed from the stream,
+// and from any feeds its other streams do not have. It returns once
+// the client has been unregistered from those feeds.
+func (h *Hub) LeaveStream(ctx context.Context, client *hub.Client, stream string) error {
+	return h.requestRegister(ctx, registerRequest{client: client, stream: stream, leave: true})
+}
+
+func (h *Hub) requestRegister(ctx context.Context, req registerRequest) error {
+
+	req.result = make(chan error, 1)
+
+	select {
+	case h.registerRequests <- req:
+	case <-h.done:
+		return h.stopped()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-req.result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handleRegister is called from the run loop
+func (h *Hub) handleRegister(req registerRequest) {
+
+	switch {
+	case req.leave:
+		h.leaveStream(req.client, req.stream)
+	case strings.HasPrefix(req.stream, streamPrefix):
+		h.options[req.client] = req.options
+		h.joinStream(req.client, req.stream)
+	default:
+		h.registerFeed(req.client)
+	}
+
+	req.result <- nil
+}
@@ -0,0 +1,91 @@
+package agg
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/timdrysdale/hub"
+)
+
+func TestJoinSeveralStreams(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	if err := h.AddRule(ctx, Rule{Stream: "stream/a", Feeds: []string{"video0", "audio"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AddRule(ctx, Rule{Stream: "stream/b", Feeds: []string{"audio", "video1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &hub.Client{Hub: h.Hub, Name: "recorder", Topic: "recorder", Send: make(chan hub.Message, 8), Stats: hub.NewClientStats()}
+	for _, stream := range []string{"stream/a", "stream/b", "stream/a"} {
+		if err := h.JoinStream(ctx, c, stream, ClientOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(when string, want map[string][]string) {
+		t.Helper()
+		s, err := h.Snapshot(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, stream := range []string{"stream/a", "stream/b"} {
+			var got []string
+			if len(s.Streams[stream]) > 0 {
+				got = s.Streams[stream][0].Feeds
+			}
+			if !reflect.DeepEqual(got, want[stream]) {
+				t.Error(when, stream, "wanted", want[stream], "got", got)
+			}
+		}
+	}
+
+	check("joined", map[string][]string{
+		"stream/a": {"audio", "video0"},
+		"stream/b": {"audio", "video1"},
+	})
+
+	// audio is in both streams, but is only delivered once
+	p := &hub.Client{Hub: h.Hub, Name: "mic", Topic: "audio", Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	h.Register <- p
+	time.Sleep(time.Millisecond)
+	h.Broadcast <- hub.Message{Data: []byte{'a'}, Sender: *p, Sent: time.Now()}
+
+	select {
+	case <-c.Send:
+	case <-time.After(time.Second):
+		t.Fatal("audio not delivered")
+	}
+	select {
+	case <-c.Send:
+		t.Error("audio delivered twice")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// joined stream/a twice, so must leave twice
+	if err := h.LeaveStream(ctx, c, "stream/a"); err != nil {
+		t.Fatal(err)
+	}
+	check("left once", map[string][]string{
+		"stream/a": {"audio", "video0"},
+		"stream/b": {"audio", "video1"},
+	})
+
+	if err := h.LeaveStream(ctx, c, "stream/a"); err != nil {
+		t.Fatal(err)
+	}
+	check("left stream/a", map[string][]string{
+		"stream/b": {"audio", "video1"},
+	})
+
+	if err := h.LeaveStream(ctx, c, "stream/b"); err != nil {
+		t.Fatal(err)
+	}
+	check("left both", map[string][]string{})
+}
@@ -0,0 +1,35 @@
+package agg
+
+import "time"
+
+// Clock tells the hub the time, and runs its timers, so that mutes and
+// schedules can be tested without waiting. Set Hub.Clock before running
+// the hub; if it is nil, the system clock is used.
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer started by a Clock. *time.Timer satisfies it.
+type Timer interface {
+	Stop() bool
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+func (h *Hub) clock() Clock {
+
+	if h.Clock == nil {
+		return systemClock{}
+	}
+
+	return h.Clock
+}
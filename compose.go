@@ -0,0 +1,146 @@
+package agg
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+var ErrCycle = errors.New("rule would make a stream contain itself")
+
+// resolve lists the topics a rule's feeds refer to, expanding any
+// patterns against the topics that currently have clients, and any
+// streams into the topics of their own rules
+func (h *Hub) resolve(rule Rule) []string {
+
+	seen := make(map[string]bool)
+	topics := []string{}
+
+	h.resolveInto(rule, map[string]bool{rule.Stream: true}, func(topic string) {
+		if !seen[topic] {
+			seen[topic] = true
+			topics = append(topics, topic)
+		}
+	})
+
+	return topics
+}
+
+// resolveInto calls add for each topic of the rule, skipping any
+// stream already being resolved so that it always terminates
+func (h *Hub) resolveInto(rule Rule, visiting map[string]bool, add func(string)) {
+
+	// leave out any topics muted in this stream, including
+	// those that come from the streams it contains
+	if len(h.mutes[rule.Stream]) > 0 {
+		next := add
+		add = func(topic string) {
+			if !h.isMuted(rule.Stream, topic) {
+				next(topic)
+			}
+		}
+	}
+
+	for _, feed := range rule.Feeds {
+
+		if strings.HasPrefix(feed, streamPrefix) {
+			inner, ok := h.rules[feed]
+			if !ok || visiting[feed] {
+				continue
+			}
+			visiting[feed] = true
+			h.resolveInto(inner, visiting, add)
+			delete(visiting, feed)
+			continue
+		}
+
+		if !isPattern(feed) {
+			add(feed)
+			continue
+		}
+
+		matches := []string{}
+		for topic := range h.feeds {
+			if matchFeed(feed, topic) {
+				matches = append(matches, topic)
+			}
+		}
+		sort.Strings(matches)
+		for _, topic := range matches {
+			add(topic)
+		}
+	}
+}
+
+// checkCycle returns an error if adding the rule would let
+// a stream contain itself, directly or through other streams
+func (h *Hub) checkCycle(rule Rule) error {
+
+	visited := make(map[string]bool)
+
+	var reaches func(feeds []string) bool
+
+	reaches = func(feeds []string) bool {
+		for _, feed := range feeds {
+			if !strings.HasPrefix(feed, streamPrefix) {
+				continue
+			}
+			if feed == rule.Stream {
+				return true
+			}
+			if visited[feed] {
+				continue
+			}
+			visited[feed] = true
+			if inner, ok := h.rules[feed]; ok && reaches(inner.Feeds) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if reaches(rule.Feeds) {
+		return &RuleError{Stream: rule.Stream, Err: ErrCycle}
+	}
+
+	return nil
+}
+
+// dependents lists the stream and every stream that contains it,
+// directly or through other streams
+func (h *Hub) dependents(stream string) []string {
+
+	found := map[string]bool{stream: true}
+	streams := []string{stream}
+
+	for changed := true; changed; {
+		changed = false
+		for s, rule := range h.rules {
+			if found[s] {
+				continue
+			}
+			for _, feed := range rule.Feeds {
+				if found[feed] {
+					found[s] = true
+					streams = append(streams, s)
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	return streams
+}
+
+// reattach brings each client of a stream into line with the topics
+// its rules now resolve to. Relays from topics the client keeps are
+// left running, so those feeds carry on without a gap.
+func (h *Hub) reattach(stream string) {
+
+	h.invalidateReplays()
+
+	for client := range h.Streams[stream] {
+		h.refresh(client)
+	}
+}
@@ -0,0 +1,92 @@
+package agg
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/timdrysdale/hub"
+)
+
+func TestComposedStreams(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	full := "stream/full"
+	video := "stream/video"
+
+	if err := h.AddRule(ctx, Rule{Stream: full, Feeds: []string{video, "audio"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &hub.Client{Hub: h.Hub, Name: "aa", Topic: full, Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	h.Register <- c
+
+	feeds := func() []string {
+		s, err := h.Snapshot(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.Streams[full][0].Feeds
+	}
+
+	if got := feeds(); !reflect.DeepEqual(got, []string{"audio"}) {
+		t.Error("wanted audio only before inner rule exists, got", got)
+	}
+
+	if err := h.AddRule(ctx, Rule{Stream: video, Feeds: []string{"video0", "audio"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := feeds(); !reflect.DeepEqual(got, []string{"audio", "video0"}) {
+		t.Error("wanted inner rule resolved without duplicates, got", got)
+	}
+
+	if err := h.AddRule(ctx, Rule{Stream: video, Feeds: []string{"video1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := feeds(); !reflect.DeepEqual(got, []string{"audio", "video1"}) {
+		t.Error("wanted dependent re-resolved after inner rule changed, got", got)
+	}
+
+	if err := h.DeleteRule(ctx, video); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := feeds(); !reflect.DeepEqual(got, []string{"audio"}) {
+		t.Error("wanted inner feeds gone after inner rule deleted, got", got)
+	}
+}
+
+func TestComposedStreamsRejectCycles(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	if err := h.AddRule(ctx, Rule{Stream: "stream/a", Feeds: []string{"stream/a"}}); !errors.Is(err, ErrCycle) {
+		t.Error("wanted ErrCycle for self reference, got", err)
+	}
+
+	if err := h.AddRule(ctx, Rule{Stream: "stream/a", Feeds: []string{"stream/b"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AddRule(ctx, Rule{Stream: "stream/b", Feeds: []string{"stream/c", "video0"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AddRule(ctx, Rule{Stream: "stream/c", Feeds: []string{"audio", "stream/a"}}); !errors.Is(err, ErrCycle) {
+		t.Error("wanted ErrCycle for indirect reference, got", err)
+	}
+
+	s, err := h.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Rules["stream/c"]; ok {
+		t.Error("rule making a cycle was stored")
+	}
+}
@@ -0,0 +1,135 @@
+package agg
+
+import (
+	"context"
+	"time"
+
+	"github.com/timdrysdale/hub"
+)
+
+// EventType says what changed
+type EventType string
+
+const (
+	RuleAdded          EventType = "ruleAdded"
+	RuleReplaced       EventType = "ruleReplaced"
+	RuleDeleted        EventType = "ruleDeleted"
+	StreamClientJoined EventType = "streamClientJoined"
+	StreamClientLeft   EventType = "streamClientLeft"
+	FeedAttached       EventType = "feedAttached"
+	FeedDetached       EventType = "feedDetached"
+)
+
+// Event describes a change to the composition of a stream. Rule is set
+// for the rule events, Client for the client and feed events, Feed
+// for the feed events, and Schedule and Error for ScheduleSkipped.
+type Event struct {
+	Type     EventType `json:"type"`
+	Time     time.Time `json:"time"`
+	Stream   string    `json:"stream"`
+	Client   string    `json:"client,omitempty"`
+	Feed     string    `json:"feed,omitempty"`
+	Rule     *Rule     `json:"rule,omitempty"`
+	Schedule string    `json:"schedule,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type subscriber struct {
+	events chan Event
+}
+
+type subscribeRequest struct {
+	sub    *subscriber
+	remove bool
+	result chan struct{}
+}
+
+// Subscribe returns a channel of events, in the order they happen. The
+// run loop never waits for a subscriber, so if the channel's buffer is
+// full, events are dropped. The channel is closed when ctx is done or
+// the hub stops.
+func (h *Hub) Subscribe(ctx context.Context, buffer int) (<-chan Event, error) {
+
+	sub := &subscriber{events: make(chan Event, buffer)}
+
+	if err := h.requestSubscribe(ctx, subscribeRequest{sub: sub}); err != nil {
+		return nil, err
+	}
+
+	// once the hub stops, the channel is closed with nothing to remove
+	go func() {
+		select {
+		case <-ctx.Done():
+			h.requestSubscribe(context.Background(), subscribeRequest{sub: sub, remove: true})
+		case <-h.done:
+		}
+	}()
+
+	return sub.events, nil
+}
+
+func (h *Hub) requestSubscribe(ctx context.Context, req subscribeRequest) error {
+
+	req.result = make(chan struct{}, 1)
+
+	select {
+	case h.subscriptions <- req:
+	case <-h.done:
+		return h.stopped()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	<-req.result
+
+	return nil
+}
+
+// handleSubscribe is called from the run loop
+func (h *Hub) handleSubscribe(req subscribeRequest) {
+
+	if !req.remove {
+		h.subscribers[req.sub] = true
+	} else if h.subscribers[req.sub] {
+		delete(h.subscribers, req.sub)
+		close(req.sub.events)
+	}
+
+	req.result <- struct{}{}
+}
+
+// emit sends an event to every subscriber that has room for it
+func (h *Hub) emit(e Event) {
+
+	if len(h.subscribers) == 0 {
+		return
+	}
+
+	e.Time = time.Now()
+
+	for sub := range h.subscribers {
+		select {
+		case sub.events <- e:
+		default:
+		}
+	}
+}
+
+func (h *Hub) emitRule(t EventType, rule Rule) {
+	r := rule.copy()
+	h.emit(Event{Type: t, Stream: rule.Stream, Rule: &r})
+}
+
+func (h *Hub) emitClient(t EventType, client *hub.Client, stream, feed string) {
+	h.emit(Event{Type: t, Stream: stream, Client: client.Name, Feed: feed})
+}
+
+// closeSubscribers ends every subscription, when the hub stops
+func (h *Hub) closeSubscribers() {
+
+	for sub := range h.subscribers {
+		close(sub.events)
+	}
+
+	h.subscribers = make(map[*subscriber]bool)
+}
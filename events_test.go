@@ -0,0 +1,120 @@
+package agg
+
+import (
+	"context"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/timdrysdale/hub"
+)
+
+func TestEvents(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	subCtx, unsubscribe := context.WithCancel(ctx)
+	events, err := h.Subscribe(subCtx, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream := "stream/large"
+	if err := h.AddRule(ctx, Rule{Stream: stream, Feeds: []string{"video0"}}); err != nil {
+		t.Fatal(err)
+	}
+	c := &hub.Client{Hub: h.Hub, Name: "aa", Topic: stream, Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	if err := h.RegisterWithOptions(ctx, c, ClientOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AddRule(ctx, Rule{Stream: stream, Feeds: []string{"audio"}}); err != nil {
+		t.Fatal(err)
+	}
+	h.Unregister <- c
+	if err := h.DeleteRule(ctx, stream); err != nil {
+		t.Fatal(err)
+	}
+
+	// a round trip so the unregister has been handled
+	if _, err := h.Snapshot(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	unsubscribe()
+
+	type summary struct {
+		Type   EventType
+		Client string
+		Feed   string
+	}
+
+	got := []summary{}
+	timeout := time.After(time.Second)
+COLLECT:
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				break COLLECT
+			}
+			if e.Stream != stream || e.Time.IsZero() {
+				t.Error("bad event", e)
+			}
+			got = append(got, summary{e.Type, e.Client, e.Feed})
+		case <-timeout:
+			t.Fatal("events channel not closed after unsubscribing")
+		}
+	}
+
+	want := []summary{
+		{RuleAdded, "", ""},
+		{StreamClientJoined, "aa", ""},
+		{FeedAttached, "aa", "video0"},
+		{RuleReplaced, "", ""},
+		// the new feed is attached before the old one is detached
+		{FeedAttached, "aa", "audio"},
+		{FeedDetached, "aa", "video0"},
+		{FeedDetached, "aa", "audio"},
+		{StreamClientLeft, "aa", ""},
+		{RuleDeleted, "", ""},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted\n%v\ngot\n%v", want, got)
+	}
+}
+
+func TestEventsClosedWhenHubStops(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() {
+		stopped <- h.RunContext(ctx)
+	}()
+
+	events, err := h.Subscribe(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	<-stopped
+
+	if _, ok := <-events; ok {
+		t.Error("events channel not closed")
+	}
+
+	// nothing is left waiting on the subscription's context
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatal("goroutines left running", runtime.NumGoroutine()-before)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
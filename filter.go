@@ -0,0 +1,158 @@
+package agg
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/timdrysdale/hub"
+)
+
+var ErrInvalidFilter = errors.New("filter has an invalid size range, or names an unregistered filter")
+
+// Filter selects the messages relayed from the feeds its key in a rule
+// matches. Fields left at their zero value do not restrict which
+// messages pass.
+type Filter struct {
+	// Types lists the hub.Message types to pass
+	Types []int `json:"types,omitempty"`
+	// MinSize and MaxSize limit the length of the message data
+	MinSize int `json:"minSize,omitempty"`
+	MaxSize int `json:"maxSize,omitempty"`
+	// Sender is a pattern the sender's name must match, using the
+	// same wildcards as feeds
+	Sender string `json:"sender,omitempty"`
+	// Name is a filter function added with RegisterFilter
+	Name string `json:"name,omitempty"`
+}
+
+// FilterFunc reports whether a message should be relayed
+type FilterFunc func(msg hub.Message) bool
+
+var (
+	filterFuncsMu sync.RWMutex
+	filterFuncs   = make(map[string]FilterFunc)
+)
+
+// RegisterFilter makes a filter function available to rules by name,
+// replacing any already registered with that name. Relays that are
+// already running keep the function they started with.
+func RegisterFilter(name string, f FilterFunc) {
+
+	if f == nil {
+		panic("agg: RegisterFilter with nil function")
+	}
+
+	filterFuncsMu.Lock()
+	defer filterFuncsMu.Unlock()
+
+	filterFuncs[name] = f
+}
+
+func filterFunc(name string) (FilterFunc, bool) {
+
+	filterFuncsMu.RLock()
+	defer filterFuncsMu.RUnlock()
+
+	f, ok := filterFuncs[name]
+
+	return f, ok
+}
+
+func (f Filter) validate() error {
+
+	if f.MinSize < 0 || f.MaxSize < 0 || (f.MaxSize > 0 && f.MaxSize < f.MinSize) {
+		return ErrInvalidFilter
+	}
+
+	if f.Name != "" {
+		if _, ok := filterFunc(f.Name); !ok {
+			return ErrInvalidFilter
+		}
+	}
+
+	return nil
+}
+
+// pass reports whether a message passes the filter, other than its
+// named function, which is looked up when the relay starts
+func (f Filter) pass(msg hub.Message) bool {
+
+	if len(f.Types) > 0 {
+		found := false
+		for _, t := range f.Types {
+			if msg.Type == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(msg.Data) < f.MinSize || (f.MaxSize > 0 && len(msg.Data) > f.MaxSize) {
+		return false
+	}
+
+	if f.Sender != "" && msg.Sender.Name != f.Sender && !matchFeed(f.Sender, msg.Sender.Name) {
+		return false
+	}
+
+	return true
+}
+
+// filtersFor returns the filters of a rule that apply to a topic,
+// in the order of their keys
+func filtersFor(rule Rule, topic string) []Filter {
+
+	keys := []string{}
+	for key := range rule.Filters {
+		if key == topic || (isPattern(key) && matchFeed(key, topic)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	filters := []Filter{}
+	for _, key := range keys {
+		filters = append(filters, rule.Filters[key])
+	}
+
+	return filters
+}
+
+// setFilters gives a subclient the filters it applies
+func (sc *SubClient) setFilters(filters []Filter) {
+
+	sc.filters = filters
+	sc.filterFuncs = nil
+
+	for _, f := range filters {
+		if f.Name == "" {
+			continue
+		}
+		if fn, ok := filterFunc(f.Name); ok {
+			sc.filterFuncs = append(sc.filterFuncs, fn)
+		}
+	}
+}
+
+// pass reports whether a message gets through all of a subclient's
+// filters
+func (sc *SubClient) pass(msg hub.Message) bool {
+
+	for _, f := range sc.filters {
+		if !f.pass(msg) {
+			return false
+		}
+	}
+
+	for _, fn := range sc.filterFuncs {
+		if !fn(msg) {
+			return false
+		}
+	}
+
+	return true
+}
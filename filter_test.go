@@ -0,0 +1,108 @@
+package agg
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/timdrysdale/hub"
+)
+
+func TestFilterPass(t *testing.T) {
+
+	msg := hub.Message{Data: []byte("hello"), Type: 1, Sender: hub.Client{Name: "lab3/sensor0"}}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   bool
+	}{
+		{"empty", Filter{}, true},
+		{"type", Filter{Types: []int{1}}, true},
+		{"wrong type", Filter{Types: []int{2}}, false},
+		{"size", Filter{MinSize: 5, MaxSize: 5}, true},
+		{"too big", Filter{MaxSize: 4}, false},
+		{"too small", Filter{MinSize: 6}, false},
+		{"sender", Filter{Sender: "lab3/*"}, true},
+		{"wrong sender", Filter{Sender: "lab4/*"}, false},
+	}
+
+	for _, test := range tests {
+		if got := test.filter.pass(msg); got != test.want {
+			t.Error(test.name, "wanted", test.want, "got", got)
+		}
+	}
+}
+
+func TestInvalidFilter(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	for _, f := range []Filter{{MinSize: 4, MaxSize: 2}, {MinSize: -1}, {Name: "unregistered"}} {
+		rule := Rule{Stream: "stream/data", Feeds: []string{"data"}, Filters: map[string]Filter{"data": f}}
+		if err := h.AddRule(ctx, rule); !errors.Is(err, ErrInvalidFilter) {
+			t.Error("wanted ErrInvalidFilter, got", err)
+		}
+	}
+}
+
+func TestRuleFilters(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	RegisterFilter("notEmpty", func(msg hub.Message) bool { return len(msg.Data) > 0 })
+
+	stream := "stream/data"
+	rule := Rule{
+		Stream: stream,
+		Feeds:  []string{"data"},
+		Filters: map[string]Filter{
+			"data": {Types: []int{1}},
+			"da*":  {MaxSize: 4, Name: "notEmpty"},
+		},
+	}
+	if err := h.AddRule(ctx, rule); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &hub.Client{Hub: h.Hub, Name: "aa", Topic: stream, Send: make(chan hub.Message, 8), Stats: hub.NewClientStats()}
+	if err := h.RegisterWithOptions(ctx, c, ClientOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	c1 := &hub.Client{Hub: h.Hub, Name: "1", Topic: "data", Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	h.Register <- c1
+	time.Sleep(time.Millisecond)
+
+	for _, msg := range []hub.Message{
+		{Data: []byte("bin"), Type: 2},
+		{Data: []byte("too long"), Type: 1},
+		{Data: []byte{}, Type: 1},
+		{Data: []byte("ok"), Type: 1},
+	} {
+		msg.Sender = *c1
+		h.Broadcast <- msg
+		// the hub drops subclients that are not ready for the next message
+		time.Sleep(time.Millisecond)
+	}
+
+	select {
+	case msg := <-c.Send:
+		if string(msg.Data) != "ok" {
+			t.Error("wanted only the message that passes every filter, got", string(msg.Data))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no message")
+	}
+
+	select {
+	case msg := <-c.Send:
+		t.Error("unexpected message", string(msg.Data))
+	case <-time.After(10 * time.Millisecond):
+	}
+}
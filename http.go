@@ -0,0 +1,222 @@
+package agg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RulesHandler returns an http.Handler for managing rules with JSON.
+// Paths are relative to where it is mounted, e.g. with
+//
+//	http.Handle("/rules/", http.StripPrefix("/rules", h.RulesHandler()))
+//
+// it serves
+//
+//	GET    /rules/               list all rules
+//	POST   /rules/               apply a Batch of changes
+//	DELETE /rules/               delete all rules
+//	GET    /rules/stream/large   get the rule for stream/large
+//	PUT    /rules/stream/large   set the rule for stream/large
+//	DELETE /rules/stream/large   delete the rule for stream/large
+//
+// Changes are applied with AddRule, DeleteRule and ApplyBatch, so a
+// response is not sent until the change has taken effect. A rule's
+// version is sent as its ETag, and a PUT or DELETE with If-Match only
+// succeeds if the rule still has that version, or with 412 if not. A
+// PUT with "If-None-Match: *" only succeeds if there is no rule yet.
+func (h *Hub) RulesHandler() http.Handler {
+	return http.HandlerFunc(h.serveRules)
+}
+
+func (h *Hub) serveRules(w http.ResponseWriter, r *http.Request) {
+
+	stream := strings.Trim(r.URL.Path, "/")
+
+	if stream == "" {
+		switch r.Method {
+		case http.MethodGet:
+			h.listRules(w, r)
+		case http.MethodPost:
+			h.postBatch(w, r)
+		case http.MethodDelete:
+			writeRuleError(w, h.DeleteAllRules(r.Context()))
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.getRule(w, r, stream)
+	case http.MethodPut:
+		h.putRule(w, r, stream)
+	case http.MethodDelete:
+		h.removeRule(w, r, stream)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Hub) listRules(w http.ResponseWriter, r *http.Request) {
+
+	s, err := h.Snapshot(r.Context())
+	if err != nil {
+		writeRuleError(w, err)
+		return
+	}
+
+	rules := []Rule{}
+	for _, rule := range s.Rules {
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Stream < rules[j].Stream })
+
+	writeJSON(w, http.StatusOK, rules)
+}
+
+func (h *Hub) getRule(w http.ResponseWriter, r *http.Request, stream string) {
+
+	s, err := h.Snapshot(r.Context())
+	if err != nil {
+		writeRuleError(w, err)
+		return
+	}
+
+	rule, ok := s.Rules[stream]
+	if !ok {
+		http.Error(w, "no rule for "+stream, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("ETag", etag(rule.Version))
+	writeJSON(w, http.StatusOK, rule)
+}
+
+func (h *Hub) putRule(w http.ResponseWriter, r *http.Request, stream string) {
+
+	var rule Rule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, "bad rule: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the stream may be left out of the body, but must not contradict the path
+	if rule.Stream == "" {
+		rule.Stream = stream
+	}
+	if rule.Stream != stream {
+		http.Error(w, "stream in rule does not match path", http.StatusBadRequest)
+		return
+	}
+
+	version, conditional, err := precondition(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	applied := Rule{}
+	req := ruleRequest{add: &rule, applied: &applied}
+	if conditional {
+		req.version = &version
+	}
+
+	if err := h.requestRule(r.Context(), req); err != nil {
+		writeRuleError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag(applied.Version))
+	writeJSON(w, http.StatusOK, applied)
+}
+
+func (h *Hub) removeRule(w http.ResponseWriter, r *http.Request, stream string) {
+
+	version, conditional, err := precondition(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !conditional {
+		writeRuleError(w, h.DeleteRule(r.Context(), stream))
+		return
+	}
+
+	writeRuleError(w, h.DeleteRuleIf(r.Context(), stream, version))
+}
+
+func etag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// precondition reads the version a request is conditional on, if any.
+// "If-None-Match: *" asks for there to be no rule, i.e. version 0.
+func precondition(r *http.Request) (uint64, bool, error) {
+
+	if r.Header.Get("If-None-Match") == "*" {
+		return 0, true, nil
+	}
+
+	match := r.Header.Get("If-Match")
+	if match == "" {
+		return 0, false, nil
+	}
+
+	version, err := strconv.ParseUint(strings.Trim(match, `"`), 10, 64)
+	if err != nil || version == 0 {
+		return 0, false, errors.New("If-Match must be a rule's ETag")
+	}
+
+	return version, true, nil
+}
+
+func (h *Hub) postBatch(w http.ResponseWriter, r *http.Request) {
+
+	var batch Batch
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		http.Error(w, "bad batch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeRuleError(w, h.ApplyBatch(r.Context(), batch))
+}
+
+// writeRuleError maps the result of a rule operation to a response
+func writeRuleError(w http.ResponseWriter, err error) {
+
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, ErrReservedName):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, ErrCycle):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrVersion):
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+	case errors.Is(err, ErrInvalidPrefix), errors.Is(err, ErrEmptyFeeds),
+		errors.Is(err, ErrInvalidPolicy), errors.Is(err, ErrInvalidReturn),
+		errors.Is(err, ErrInvalidFilter), errors.Is(err, ErrInvalidTransform),
+		errors.Is(err, ErrInvalidLimit), errors.Is(err, ErrInvalidReplay):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrHubClosed), errors.Is(err, context.Canceled),
+		errors.Is(err, context.DeadlineExceeded):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
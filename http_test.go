@@ -0,0 +1,132 @@
+package agg
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRulesHandler(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	handler := h.RulesHandler()
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{"PUT", "/stream/large", `{"feeds":["video0","audio"]}`, http.StatusOK},
+		{"PUT", "/stream/small", `{"stream":"stream/small","feeds":["video1"]}`, http.StatusOK},
+		{"PUT", "/stream/small", `{"stream":"stream/large","feeds":["video1"]}`, http.StatusBadRequest},
+		{"PUT", "/large", `{"feeds":["video0"]}`, http.StatusBadRequest},
+		{"PUT", "/stream/large", `{"feeds":[]}`, http.StatusBadRequest},
+		{"PUT", "/stream/large", `not json`, http.StatusBadRequest},
+		{"PUT", "/deleteAll", `{"feeds":["video0"]}`, http.StatusForbidden},
+		{"DELETE", "/deleteAll", ``, http.StatusForbidden},
+		{"GET", "/stream/large", ``, http.StatusOK},
+		{"GET", "/stream/none", ``, http.StatusNotFound},
+		{"POST", "/stream/large", ``, http.StatusMethodNotAllowed},
+		{"DELETE", "/stream/small", ``, http.StatusNoContent},
+	}
+
+	for _, test := range tests {
+		if rec := do(test.method, test.path, test.body); rec.Code != test.want {
+			t.Errorf("%s %s: wanted %d got %d %s", test.method, test.path, test.want, rec.Code, rec.Body.String())
+		}
+	}
+
+	rec := do("GET", "/", "")
+	var rules []Rule
+	if err := json.NewDecoder(rec.Body).Decode(&rules); err != nil {
+		t.Fatal(err)
+	}
+	want := []Rule{{Stream: "stream/large", Feeds: []string{"video0", "audio"}, Version: 1}}
+	if !reflect.DeepEqual(rules, want) {
+		t.Error("wanted", want, "got", rules)
+	}
+
+	batch := `{"delete":["stream/large"],"add":[{"stream":"stream/small","feeds":["video1"]}]}`
+	if rec := do("POST", "/", batch); rec.Code != http.StatusNoContent {
+		t.Error("batch: wanted 204, got", rec.Code, rec.Body.String())
+	}
+	if rec := do("POST", "/", `{"add":[{"stream":"stream/bad","feeds":[]}]}`); rec.Code != http.StatusBadRequest {
+		t.Error("invalid batch: wanted 400, got", rec.Code)
+	}
+	if rec := do("GET", "/stream/small", ""); rec.Code != http.StatusOK {
+		t.Error("wanted rule added by batch, got", rec.Code)
+	}
+
+	if rec := do("DELETE", "/", ""); rec.Code != http.StatusNoContent {
+		t.Error("delete all: wanted 204, got", rec.Code)
+	}
+	if rec := do("GET", "/", ""); strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Error("wanted no rules after delete all, got", rec.Body.String())
+	}
+}
+
+func TestRulesHandlerVersions(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	handler := h.RulesHandler()
+
+	do := func(method, path, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do("PUT", "/stream/large", `{"feeds":["video0"]}`, "If-None-Match", "*")
+	if rec.Code != http.StatusOK {
+		t.Fatal("create: wanted 200, got", rec.Code, rec.Body.String())
+	}
+	first := rec.Header().Get("ETag")
+
+	if rec := do("PUT", "/stream/large", `{"feeds":["video1"]}`, "If-None-Match", "*"); rec.Code != http.StatusPreconditionFailed {
+		t.Error("create existing: wanted 412, got", rec.Code)
+	}
+
+	rec = do("PUT", "/stream/large", `{"feeds":["video1"]}`, "If-Match", first)
+	if rec.Code != http.StatusOK {
+		t.Fatal("update: wanted 200, got", rec.Code, rec.Body.String())
+	}
+	second := rec.Header().Get("ETag")
+
+	if rec := do("GET", "/stream/large", ""); rec.Header().Get("ETag") != second {
+		t.Error("wanted ETag", second, "got", rec.Header().Get("ETag"))
+	}
+
+	if rec := do("PUT", "/stream/large", `{"feeds":["audio"]}`, "If-Match", first); rec.Code != http.StatusPreconditionFailed {
+		t.Error("stale update: wanted 412, got", rec.Code)
+	}
+	if rec := do("DELETE", "/stream/large", "", "If-Match", first); rec.Code != http.StatusPreconditionFailed {
+		t.Error("stale delete: wanted 412, got", rec.Code)
+	}
+	if rec := do("DELETE", "/stream/large", "", "If-Match", "nonsense"); rec.Code != http.StatusBadRequest {
+		t.Error("bad If-Match: wanted 400, got", rec.Code)
+	}
+	if rec := do("DELETE", "/stream/large", "", "If-Match", second); rec.Code != http.StatusNoContent {
+		t.Error("delete: wanted 204, got", rec.Code)
+	}
+}
@@ -0,0 +1,173 @@
+package agg
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/timdrysdale/hub"
+)
+
+var ErrInvalidLimit = errors.New("rate limit must not be negative")
+
+// RateLimit sets the most a stream client is sent, from a stream's
+// rule or the client's options. Zero values do not limit.
+type RateLimit struct {
+	// Messages and Bytes are per second
+	Messages float64 `json:"messages,omitempty"`
+	Bytes    float64 `json:"bytes,omitempty"`
+	// Decimate, if more than one, relays every Nth message of each feed
+	Decimate int `json:"decimate,omitempty"`
+}
+
+func (l RateLimit) validate() error {
+
+	for _, v := range []float64{l.Messages, l.Bytes} {
+		if v < 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+			return ErrInvalidLimit
+		}
+	}
+
+	if l.Decimate < 0 {
+		return ErrInvalidLimit
+	}
+
+	return nil
+}
+
+// limitFor returns the rate limit for a stream client, from its
+// options or else the rule of the stream
+func (h *Hub) limitFor(client *hub.Client, rule Rule) RateLimit {
+
+	if l := h.options[client].Limit; l != nil {
+		return *l
+	}
+
+	if rule.Limit != nil {
+		return *rule.Limit
+	}
+
+	return RateLimit{}
+}
+
+// limiterFor returns the token buckets a stream client shares between
+// the feeds that have the same limit, or nil if there is no rate
+func (h *Hub) limiterFor(client *hub.Client, limit RateLimit) *limiter {
+
+	if limit.Messages == 0 && limit.Bytes == 0 {
+		return nil
+	}
+
+	if _, ok := h.limiters[client]; !ok {
+		h.limiters[client] = make(map[RateLimit]*limiter)
+	}
+
+	if _, ok := h.limiters[client][limit]; !ok {
+		h.limiters[client][limit] = newLimiter(limit)
+	}
+
+	return h.limiters[client][limit]
+}
+
+// limiter is a pair of token buckets, for messages and bytes. The
+// buckets may go into debt, so that a message bigger than the bucket
+// can still be sent once it is full, with the next waiting longer.
+type limiter struct {
+	sync.Mutex
+	limit    RateLimit
+	messages float64
+	bytes    float64
+	last     time.Time
+}
+
+func newLimiter(limit RateLimit) *limiter {
+
+	l := &limiter{limit: limit, last: time.Now()}
+	l.messages = l.capacity()
+	l.bytes = limit.Bytes
+
+	return l
+}
+
+// capacity is the size of the message bucket, which holds at least
+// one message so that rates below one per second can be met
+func (l *limiter) capacity() float64 {
+	return math.Max(1, l.limit.Messages)
+}
+
+// fill adds the tokens earned since it was last called
+func (l *limiter) fill(now time.Time) {
+
+	elapsed := now.Sub(l.last).Seconds()
+	l.last = now
+
+	if l.limit.Messages > 0 {
+		l.messages = math.Min(l.capacity(), l.messages+elapsed*l.limit.Messages)
+	}
+
+	if l.limit.Bytes > 0 {
+		l.bytes = math.Min(l.limit.Bytes, l.bytes+elapsed*l.limit.Bytes)
+	}
+}
+
+// delay returns how long until a message of size n can be sent
+func (l *limiter) delay(n int) time.Duration {
+
+	if l == nil {
+		return 0
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.fill(time.Now())
+
+	var wait float64
+
+	if l.limit.Messages > 0 && l.messages < 1 {
+		wait = (1 - l.messages) / l.limit.Messages
+	}
+
+	if l.limit.Bytes > 0 {
+		if need := math.Min(float64(n), l.limit.Bytes); l.bytes < need {
+			wait = math.Max(wait, (need-l.bytes)/l.limit.Bytes)
+		}
+	}
+
+	return time.Duration(wait * float64(time.Second))
+}
+
+// take spends the tokens for a message of size n
+func (l *limiter) take(n int) {
+
+	if l == nil {
+		return
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.fill(time.Now())
+
+	if l.limit.Messages > 0 {
+		l.messages--
+	}
+
+	if l.limit.Bytes > 0 {
+		l.bytes -= float64(n)
+	}
+}
+
+// decimate reports whether a message from the feed is to be kept
+func (sc *SubClient) decimate() bool {
+
+	if sc.limit.Decimate < 2 {
+		return true
+	}
+
+	keep := sc.skipped == 0
+	sc.skipped = (sc.skipped + 1) % sc.limit.Decimate
+
+	return keep
+}
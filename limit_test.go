@@ -0,0 +1,197 @@
+package agg
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/timdrysdale/hub"
+)
+
+func TestLimiter(t *testing.T) {
+
+	l := newLimiter(RateLimit{Messages: 2, Bytes: 100})
+
+	for i := 0; i < 2; i++ {
+		if d := l.delay(10); d != 0 {
+			t.Error("wanted no delay within the burst, got", d)
+		}
+		l.take(10)
+	}
+
+	if d := l.delay(10); d < 400*time.Millisecond || d > 500*time.Millisecond {
+		t.Error("wanted to wait for a message token, got", d)
+	}
+
+	// a message bigger than the bucket waits for it to be full
+	l = newLimiter(RateLimit{Bytes: 100})
+	l.take(50)
+	if d := l.delay(1000); d < 400*time.Millisecond || d > 500*time.Millisecond {
+		t.Error("wanted to wait for a full bucket, got", d)
+	}
+
+	var none *limiter
+	if d := none.delay(1000); d != 0 {
+		t.Error("wanted no delay without a limit, got", d)
+	}
+}
+
+func TestInvalidLimit(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	for _, l := range []RateLimit{{Messages: -1}, {Bytes: -1}, {Decimate: -1}} {
+		l := l
+		rule := Rule{Stream: "stream/data", Feeds: []string{"data"}, Limit: &l}
+		if err := h.AddRule(ctx, rule); !errors.Is(err, ErrInvalidLimit) {
+			t.Error("wanted ErrInvalidLimit, got", err)
+		}
+	}
+
+	c := &hub.Client{Hub: h.Hub, Name: "aa", Topic: "stream/data", Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	if err := h.RegisterWithOptions(ctx, c, ClientOptions{Limit: &RateLimit{Messages: -1}}); !errors.Is(err, ErrInvalidLimit) {
+		t.Error("wanted ErrInvalidLimit, got", err)
+	}
+}
+
+func TestDecimate(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	stream := "stream/video"
+	rule := Rule{Stream: stream, Feeds: []string{"video0"}, Limit: &RateLimit{Decimate: 3}}
+	if err := h.AddRule(ctx, rule); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &hub.Client{Hub: h.Hub, Name: "aa", Topic: stream, Send: make(chan hub.Message, 8), Stats: hub.NewClientStats()}
+	if err := h.RegisterWithOptions(ctx, c, ClientOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	c1 := &hub.Client{Hub: h.Hub, Name: "1", Topic: "video0", Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	h.Register <- c1
+	time.Sleep(time.Millisecond)
+
+	for i := 0; i < 7; i++ {
+		h.Broadcast <- hub.Message{Sender: *c1, Data: []byte(strconv.Itoa(i))}
+		// the hub drops subclients that are not ready for the next message
+		time.Sleep(time.Millisecond)
+	}
+
+	for _, want := range []string{"0", "3", "6"} {
+		select {
+		case msg := <-c.Send:
+			if string(msg.Data) != want {
+				t.Error("wanted", want, "got", string(msg.Data))
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no message")
+		}
+	}
+
+	stats, err := h.StreamStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stats[stream].Feeds["video0"]; got.Dropped != 4 {
+		t.Error("wanted four dropped, got", got.Dropped)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	stream := "stream/video"
+	rule := Rule{Stream: stream, Feeds: []string{"video0"}}
+	if err := h.AddRule(ctx, rule); err != nil {
+		t.Fatal(err)
+	}
+
+	// the client's own limit replaces the rule's, which has none; the
+	// default policy blocks, but the relay must still keep up with the hub
+	c := &hub.Client{Hub: h.Hub, Name: "aa", Topic: stream, Send: make(chan hub.Message, 16), Stats: hub.NewClientStats()}
+	if err := h.RegisterWithOptions(ctx, c, ClientOptions{Limit: &RateLimit{Messages: 10}}); err != nil {
+		t.Fatal(err)
+	}
+
+	c1 := &hub.Client{Hub: h.Hub, Name: "1", Topic: "video0", Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	h.Register <- c1
+	time.Sleep(time.Millisecond)
+
+	start := time.Now()
+
+	for i := 0; i < 14; i++ {
+		h.Broadcast <- hub.Message{Sender: *c1, Data: []byte(strconv.Itoa(i))}
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i < 14; i++ {
+		select {
+		case msg := <-c.Send:
+			if string(msg.Data) != strconv.Itoa(i) {
+				t.Error("wanted", i, "got", string(msg.Data))
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no message")
+		}
+	}
+
+	// ten are sent at once, and the rest a tenth of a second apart
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Error("rate limit not applied, took", elapsed)
+	}
+}
+
+func TestRateLimitDisconnect(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	stream := "stream/video"
+	rule := Rule{Stream: stream, Feeds: []string{"video0"}, Limit: &RateLimit{Messages: 10}}
+	if err := h.AddRule(ctx, rule); err != nil {
+		t.Fatal(err)
+	}
+
+	// c takes one message, then stalls
+	c := &hub.Client{Hub: h.Hub, Name: "aa", Topic: stream, Send: make(chan hub.Message, 1), Stats: hub.NewClientStats()}
+	policy := &RelayPolicy{Mode: RelayDisconnect, Timeout: 50 * time.Millisecond}
+	if err := h.RegisterWithOptions(ctx, c, ClientOptions{Policy: policy}); err != nil {
+		t.Fatal(err)
+	}
+
+	c1 := &hub.Client{Hub: h.Hub, Name: "1", Topic: "video0", Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	h.Register <- c1
+	time.Sleep(time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		h.Broadcast <- hub.Message{Sender: *c1, Data: []byte(strconv.Itoa(i))}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the rate limit allows the second message at once, so the
+	// timeout runs out while c is stalled, and c is disconnected
+	time.Sleep(100 * time.Millisecond)
+
+	for _, want := range []bool{true, false} {
+		select {
+		case _, ok := <-c.Send:
+			if ok != want {
+				t.Fatal("wanted the first message, then Send closed")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("stalled client not disconnected")
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package agg
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// MetricsHandler serves the hub's metrics in the Prometheus text
+// exposition format, e.g. for mounting at /metrics
+func (h *Hub) MetricsHandler() http.Handler {
+	return http.HandlerFunc(h.serveMetrics)
+}
+
+func (h *Hub) serveMetrics(w http.ResponseWriter, r *http.Request) {
+
+	snapshot, err := h.Snapshot(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	stats, err := h.StreamStats(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	m := &metricWriter{w: bufio.NewWriter(w)}
+
+	streams, clients := 0, 0
+	for _, list := range snapshot.Streams {
+		if len(list) > 0 {
+			streams++
+		}
+		clients += len(list)
+	}
+
+	m.header("agg_streams", "gauge", "Streams with at least one client.")
+	m.sample("agg_streams", nil, float64(streams))
+	m.header("agg_rules", "gauge", "Stream rules.")
+	m.sample("agg_rules", nil, float64(len(snapshot.Rules)))
+	m.header("agg_stream_clients", "gauge", "Registrations of clients to streams, counting a client once for each stream.")
+	m.sample("agg_stream_clients", nil, float64(clients))
+	m.header("agg_subclients", "gauge", "Subclients relaying feeds to stream clients.")
+	m.sample("agg_subclients", nil, float64(snapshot.SubClients))
+	m.header("agg_relay_goroutines", "gauge", "Relay goroutines running.")
+	m.sample("agg_relay_goroutines", nil, float64(atomic.LoadInt64(h.running)))
+
+	names := make([]string, 0, len(stats))
+	for stream := range stats {
+		names = append(names, stream)
+	}
+	sort.Strings(names)
+
+	m.header("agg_stream_subscribers", "gauge", "Clients registered to each stream.")
+	for _, stream := range names {
+		m.sample("agg_stream_subscribers", []string{"stream", stream}, float64(stats[stream].Subscribers))
+	}
+
+	feedCounter := func(name, help string, value func(RelayStats) uint64) {
+		m.header(name, "counter", help)
+		for _, stream := range names {
+			feeds := make([]string, 0, len(stats[stream].Feeds))
+			for feed := range stats[stream].Feeds {
+				feeds = append(feeds, feed)
+			}
+			sort.Strings(feeds)
+			for _, feed := range feeds {
+				m.sample(name, []string{"stream", stream, "feed", feed}, float64(value(stats[stream].Feeds[feed])))
+			}
+		}
+	}
+
+	feedCounter("agg_relayed_messages_total", "Messages relayed from each feed into each stream.",
+		func(s RelayStats) uint64 { return s.Messages })
+	feedCounter("agg_relayed_bytes_total", "Bytes relayed from each feed into each stream.",
+		func(s RelayStats) uint64 { return s.Bytes })
+	feedCounter("agg_dropped_messages_total", "Messages from each feed dropped by relay policy.",
+		func(s RelayStats) uint64 { return s.Dropped })
+	feedCounter("agg_transform_errors_total", "Messages from each feed lost to failed transforms.",
+		func(s RelayStats) uint64 { return s.Errors })
+
+	m.w.Flush()
+}
+
+// metricWriter writes the text exposition format
+type metricWriter struct {
+	w *bufio.Writer
+}
+
+func (m *metricWriter) header(name, kind, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one value, with labels given as name, value pairs
+func (m *metricWriter) sample(name string, labels []string, value float64) {
+
+	m.w.WriteString(name)
+
+	if len(labels) > 0 {
+		m.w.WriteString("{")
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				m.w.WriteString(",")
+			}
+			fmt.Fprintf(m.w, "%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		m.w.WriteString("}")
+	}
+
+	fmt.Fprintf(m.w, " %g\n", value)
+}
+
+var labelEscaper = strings.NewReplacer("\\", `\\`, "\"", `\"`, "\n", `\n`)
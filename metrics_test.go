@@ -0,0 +1,101 @@
+package agg
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/timdrysdale/hub"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	go h.RunContext(ctx)
+
+	stream := "stream/large"
+	if err := h.AddRule(ctx, Rule{Stream: stream, Feeds: []string{"video0", "audio"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &hub.Client{Hub: h.Hub, Name: "aa", Topic: stream, Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	h.Register <- c
+
+	rec := httptest.NewRecorder()
+	h.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatal("wanted 200, got", rec.Code)
+	}
+
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE agg_streams gauge\n",
+		"agg_streams 1\n",
+		"agg_rules 1\n",
+		"agg_stream_clients 1\n",
+		"agg_subclients 2\n",
+		"agg_relay_goroutines 2\n",
+		`agg_stream_subscribers{stream="stream/large"} 1` + "\n",
+		"# TYPE agg_relayed_messages_total counter\n",
+		`agg_relayed_messages_total{stream="stream/large",feed="video0"} 0` + "\n",
+		`agg_dropped_messages_total{stream="stream/large",feed="audio"} 0` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+
+	cancel()
+	<-h.done
+
+	rec = httptest.NewRecorder()
+	h.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Error("wanted 503 once hub stopped, got", rec.Code)
+	}
+}
+
+func TestMetricsSharedFeed(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	if err := h.AddRule(ctx, Rule{Stream: "stream/a", Feeds: []string{"video0", "audio"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AddRule(ctx, Rule{Stream: "stream/b", Feeds: []string{"audio", "video1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &hub.Client{Hub: h.Hub, Name: "recorder", Topic: "recorder", Send: make(chan hub.Message, 8), Stats: hub.NewClientStats()}
+	for _, stream := range []string{"stream/a", "stream/b"} {
+		if err := h.JoinStream(ctx, c, stream, ClientOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	// audio is relayed once, although it is listed in both streams
+	body := rec.Body.String()
+	for _, want := range []string{
+		"agg_stream_clients 2\n",
+		"agg_subclients 3\n",
+		"agg_relay_goroutines 3\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+}
+
+func TestMetricLabelsEscaped(t *testing.T) {
+	if got := labelEscaper.Replace("a\"b\\c\nd"); got != `a\"b\\c\nd` {
+		t.Error("wrong escaping", got)
+	}
+}
@@ -0,0 +1,247 @@
+package agg
+
+// MPEG transport stream packets are a fixed size, and start with a sync byte
+const (
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+)
+
+// isTransportStream reports whether data is a whole number of TS packets
+func isTransportStream(data []byte) bool {
+
+	if len(data) == 0 || len(data)%tsPacketSize != 0 {
+		return false
+	}
+
+	for i := 0; i < len(data); i += tsPacketSize {
+		if data[i] != tsSyncByte {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isRandomAccess reports whether a decoder could start from this message,
+// i.e. it contains a TS packet with the random_access_indicator set in its
+// adaptation field. Messages that are not a transport stream are always
+// random access, because there is nothing to tell us otherwise.
+func isRandomAccess(data []byte) bool {
+
+	if !isTransportStream(data) {
+		return true
+	}
+
+	for i := 0; i < len(data); i += tsPacketSize {
+		if tsRandomAccess(data[i : i+tsPacketSize]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tsRandomAccess checks the random_access_indicator of a single packet
+func tsRandomAccess(p []byte) bool {
+
+	// adaptation_field_control is 2 (adaptation only) or 3 (both)
+	if p[3]&0x20 == 0 {
+		return false
+	}
+
+	// adaptation_field_length, then the flags byte
+	if p[4] == 0 {
+		return false
+	}
+
+	return p[5]&0x40 != 0
+}
+
+// PIDs and table ids with a fixed meaning
+const (
+	tsPATPID   = 0x0000
+	tsNullPID  = 0x1FFF
+	tsPATTable = 0x00
+	tsPMTTable = 0x02
+)
+
+// tsPID returns the packet identifier of a packet
+func tsPID(p []byte) uint16 {
+	return uint16(p[1]&0x1F)<<8 | uint16(p[2])
+}
+
+// tsPayload returns the payload of a packet, after any adaptation field
+func tsPayload(p []byte) []byte {
+
+	control := (p[3] >> 4) & 0x03
+
+	if control&0x01 == 0 {
+		return nil
+	}
+
+	start := 4
+	if control&0x02 != 0 {
+		start += 1 + int(p[4])
+	}
+
+	if start >= tsPacketSize {
+		return nil
+	}
+
+	return p[start:]
+}
+
+// tsSection returns the PSI section that starts in a packet, if all of
+// it is in that packet. Sections that span packets are not needed for
+// the tables we read, which are short.
+func tsSection(p []byte, table byte) ([]byte, bool) {
+
+	// payload_unit_start_indicator marks the start of a section
+	if p[1]&0x40 == 0 {
+		return nil, false
+	}
+
+	payload := tsPayload(p)
+	if len(payload) == 0 || 1+int(payload[0]) >= len(payload) {
+		return nil, false
+	}
+
+	// skip the pointer_field
+	s := payload[1+int(payload[0]):]
+	if len(s) < 3 || s[0] != table {
+		return nil, false
+	}
+
+	// section_length counts the bytes after it, including the CRC
+	end := 3 + (int(s[1]&0x0F)<<8 | int(s[2]))
+	if end > len(s) || end < 12 {
+		return nil, false
+	}
+
+	return s[:end-4], true
+}
+
+// parsePAT returns the PMT PID of the first program in a PAT packet
+func parsePAT(p []byte) (uint16, bool) {
+
+	s, ok := tsSection(p, tsPATTable)
+	if !ok {
+		return 0, false
+	}
+
+	for i := 8; i+4 <= len(s); i += 4 {
+		// program 0 is the network information table
+		if program := uint16(s[i])<<8 | uint16(s[i+1]); program != 0 {
+			return uint16(s[i+2]&0x1F)<<8 | uint16(s[i+3]), true
+		}
+	}
+
+	return 0, false
+}
+
+// esInfo describes an elementary stream in a PMT
+type esInfo struct {
+	streamType byte
+	pid        uint16
+	info       []byte
+}
+
+// parsePMT returns the PCR PID and elementary streams of a PMT packet
+func parsePMT(p []byte) (uint16, []esInfo, bool) {
+
+	s, ok := tsSection(p, tsPMTTable)
+	if !ok {
+		return 0, nil, false
+	}
+
+	pcr := uint16(s[8]&0x1F)<<8 | uint16(s[9])
+
+	streams := []esInfo{}
+
+	i := 12 + (int(s[10]&0x0F)<<8 | int(s[11]))
+
+	for i+5 <= len(s) {
+		n := int(s[i+3]&0x0F)<<8 | int(s[i+4])
+		if i+5+n > len(s) {
+			return 0, nil, false
+		}
+		streams = append(streams, esInfo{
+			streamType: s[i],
+			pid:        uint16(s[i+1]&0x1F)<<8 | uint16(s[i+2]),
+			info:       append([]byte(nil), s[i+5:i+5+n]...),
+		})
+		i += 5 + n
+	}
+
+	return pcr, streams, true
+}
+
+// psiSection builds a long form PSI section, with its CRC
+func psiSection(table byte, id uint16, version byte, body []byte) []byte {
+
+	n := 5 + len(body) + 4
+
+	s := []byte{
+		table,
+		0xB0 | byte(n>>8), byte(n),
+		byte(id >> 8), byte(id),
+		0xC1 | (version&0x1F)<<1, // current_next_indicator set
+		0x00, 0x00,               // section_number, last_section_number
+	}
+	s = append(s, body...)
+
+	crc := crc32MPEG(s)
+
+	return append(s, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}
+
+// psiPacket puts a section in a packet of its own, padded with 0xFF
+func psiPacket(pid uint16, cc byte, section []byte) []byte {
+
+	p := make([]byte, tsPacketSize)
+
+	p[0] = tsSyncByte
+	p[1] = 0x40 | byte(pid>>8) // payload_unit_start_indicator
+	p[2] = byte(pid)
+	p[3] = 0x10 | cc&0x0F // payload only
+	p[4] = 0x00           // pointer_field
+
+	n := copy(p[5:], section)
+
+	for i := 5 + n; i < tsPacketSize; i++ {
+		p[i] = 0xFF
+	}
+
+	return p
+}
+
+// crcTable is for the CRC-32/MPEG-2 used by PSI sections
+var crcTable = func() [256]uint32 {
+
+	var t [256]uint32
+
+	for i := range t {
+		c := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if c&0x80000000 != 0 {
+				c = c<<1 ^ 0x04C11DB7
+			} else {
+				c <<= 1
+			}
+		}
+		t[i] = c
+	}
+
+	return t
+}()
+
+func crc32MPEG(data []byte) uint32 {
+
+	crc := uint32(0xFFFFFFFF)
+
+	for _, b := range data {
+		crc = crc<<8 ^ crcTable[byte(crc>>24)^b]
+	}
+
+	return crc
+}
@@ -0,0 +1,81 @@
+package agg
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// tsPacket makes a TS packet for pid, with an adaptation field
+// carrying the random access indicator if rai is set
+func tsPacket(pid uint16, rai bool) []byte {
+	p := make([]byte, tsPacketSize)
+	p[0] = tsSyncByte
+	p[1] = byte(pid>>8) & 0x1f
+	p[2] = byte(pid)
+	if rai {
+		p[3] = 0x30 // adaptation field and payload
+		p[4] = 1
+		p[5] = 0x40
+	} else {
+		p[3] = 0x10 // payload only
+	}
+	return p
+}
+
+func TestIsRandomAccess(t *testing.T) {
+
+	key := append(tsPacket(0x100, false), tsPacket(0x100, true)...)
+	delta := append(tsPacket(0x100, false), tsPacket(0x100, false)...)
+
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"keyframe", key, true},
+		{"delta", delta, false},
+		{"not ts", []byte("hello"), true},
+		{"bad sync", append([]byte{0}, key[1:]...), true},
+		{"empty", []byte{}, true},
+	}
+
+	for _, test := range tests {
+		if got := isRandomAccess(test.data); got != test.want {
+			t.Error(test.name, "wanted", test.want, "got", got)
+		}
+	}
+}
+
+func TestPSI(t *testing.T) {
+
+	// the PAT that ffmpeg writes by default
+	want := []byte{0x00, 0xB0, 0x0D, 0x00, 0x01, 0xC1, 0x00, 0x00, 0x00, 0x01, 0xF0, 0x00, 0x2A, 0xB1, 0x04, 0xB2}
+	section := psiSection(tsPATTable, 1, 0, []byte{0x00, 0x01, 0xF0, 0x00})
+	if !bytes.Equal(section, want) {
+		t.Errorf("wrong PAT section % X", section)
+	}
+
+	pmt, ok := parsePAT(psiPacket(tsPATPID, 0, section))
+	if !ok || pmt != 0x1000 {
+		t.Error("wrong PMT PID", pmt, ok)
+	}
+
+	// PCR on 0x100, with H.264 video and AAC audio, the audio with a language descriptor
+	streams := []esInfo{
+		{streamType: 0x1B, pid: 0x100},
+		{streamType: 0x0F, pid: 0x101, info: []byte{0x0A, 0x04, 'e', 'n', 'g', 0x00}},
+	}
+	body := []byte{0xE1, 0x00, 0xF0, 0x00,
+		0x1B, 0xE1, 0x00, 0xF0, 0x00,
+		0x0F, 0xE1, 0x01, 0xF0, 0x06, 0x0A, 0x04, 'e', 'n', 'g', 0x00}
+
+	pcr, got, ok := parsePMT(psiPacket(0x1000, 0, psiSection(tsPMTTable, 1, 0, body)))
+	if !ok || pcr != 0x100 || !reflect.DeepEqual(got, streams) {
+		t.Error("wrong PMT", pcr, got, ok)
+	}
+
+	if _, _, ok := parsePMT(tsPacket(0x1000, false)); ok {
+		t.Error("parsed PMT from packet without one")
+	}
+}
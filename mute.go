@@ -0,0 +1,197 @@
+package agg
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+)
+
+const (
+	FeedMuted   EventType = "feedMuted"
+	FeedUnmuted EventType = "feedUnmuted"
+)
+
+var ErrInvalidMute = errors.New("mute needs a feed, and a duration that is not negative")
+
+// Mute describes a muted feed. A zero Until means it is muted until
+// UnmuteFeed is called.
+type Mute struct {
+	Feed  string    `json:"feed"`
+	Until time.Time `json:"until,omitempty"`
+}
+
+type mute struct {
+	until time.Time
+	timer Timer
+}
+
+type muteRequest struct {
+	stream   string
+	feed     string
+	duration time.Duration
+	unmute   bool
+	result   chan error
+}
+
+// muteExpiry is sent by a mute's timer; until tells the run loop which
+// mute it was for, in case the feed has been muted again since
+type muteExpiry struct {
+	stream string
+	feed   string
+	until  time.Time
+}
+
+// MuteFeed stops relaying a feed to the clients of a stream, for the
+// duration if it is more than zero, or else until UnmuteFeed is called.
+// Muting a feed that is already muted replaces the duration. A negative
+// duration is rejected, rather than muting the feed for good. Mutes are
+// kept when the stream's rule is replaced or deleted.
+func (h *Hub) MuteFeed(ctx context.Context, stream, feed string, duration time.Duration) error {
+	return h.requestMute(ctx, muteRequest{stream: stream, feed: feed, duration: duration})
+}
+
+// UnmuteFeed resumes relaying a muted feed to the clients of a stream
+func (h *Hub) UnmuteFeed(ctx context.Context, stream, feed string) error {
+	return h.requestMute(ctx, muteRequest{stream: stream, feed: feed, unmute: true})
+}
+
+func (h *Hub) requestMute(ctx context.Context, req muteRequest) error {
+
+	if err := validateStream(req.stream); err != nil {
+		return err
+	}
+
+	if req.feed == "" || req.duration < 0 {
+		return &RuleError{Stream: req.stream, Err: ErrInvalidMute}
+	}
+
+	req.result = make(chan error, 1)
+
+	select {
+	case h.muteRequests <- req:
+	case <-h.done:
+		return h.stopped()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-req.result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handleMute is called from the run loop
+func (h *Hub) handleMute(req muteRequest) {
+
+	if req.unmute {
+		h.unmute(req.stream, req.feed)
+		req.result <- nil
+		return
+	}
+
+	if m, ok := h.mutes[req.stream][req.feed]; ok && m.timer != nil {
+		m.timer.Stop()
+	}
+
+	m := &mute{}
+
+	if req.duration > 0 {
+		m.until = h.clock().Now().Add(req.duration)
+		expiry := muteExpiry{stream: req.stream, feed: req.feed, until: m.until}
+		m.timer = h.clock().AfterFunc(req.duration, func() {
+			select {
+			case h.muteExpiries <- expiry:
+			case <-h.done:
+			}
+		})
+	}
+
+	if _, ok := h.mutes[req.stream]; !ok {
+		h.mutes[req.stream] = make(map[string]*mute)
+	}
+	h.mutes[req.stream][req.feed] = m
+
+	h.emit(Event{Type: FeedMuted, Stream: req.stream, Feed: req.feed})
+	h.refreshStream(req.stream)
+
+	req.result <- nil
+}
+
+// handleMuteExpiry is called from the run loop
+func (h *Hub) handleMuteExpiry(e muteExpiry) {
+
+	if m, ok := h.mutes[e.stream][e.feed]; ok && m.until.Equal(e.until) {
+		h.unmute(e.stream, e.feed)
+	}
+}
+
+func (h *Hub) unmute(stream, feed string) {
+
+	m, ok := h.mutes[stream][feed]
+	if !ok {
+		return
+	}
+
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+
+	delete(h.mutes[stream], feed)
+	if len(h.mutes[stream]) == 0 {
+		delete(h.mutes, stream)
+	}
+
+	h.emit(Event{Type: FeedUnmuted, Stream: stream, Feed: feed})
+	h.refreshStream(stream)
+}
+
+// isMuted reports whether a topic is muted in a stream
+func (h *Hub) isMuted(stream, topic string) bool {
+
+	for feed := range h.mutes[stream] {
+		if feed == topic || (isPattern(feed) && matchFeed(feed, topic)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// refreshStream brings the clients of a stream, and of any streams
+// containing it, into line with their rules
+func (h *Hub) refreshStream(stream string) {
+
+	for _, s := range h.dependents(stream) {
+		h.reattach(s)
+	}
+}
+
+// muteList returns the mutes of a stream, sorted by feed
+func (h *Hub) muteList(stream string) []Mute {
+
+	mutes := []Mute{}
+
+	for feed, m := range h.mutes[stream] {
+		mutes = append(mutes, Mute{Feed: feed, Until: m.until})
+	}
+
+	sort.Slice(mutes, func(i, j int) bool { return mutes[i].Feed < mutes[j].Feed })
+
+	return mutes
+}
+
+// stopMutes stops the mute timers, when the hub stops
+func (h *Hub) stopMutes() {
+
+	for _, feeds := range h.mutes {
+		for _, m := range feeds {
+			if m.timer != nil {
+				m.timer.Stop()
+			}
+		}
+	}
+}
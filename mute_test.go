@@ -0,0 +1,159 @@
+package agg
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/timdrysdale/hub"
+)
+
+func TestMuteFeed(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	stream := "stream/large"
+	if err := h.AddRule(ctx, Rule{Stream: stream, Feeds: []string{"video0", "audio"}}); err != nil {
+		t.Fatal(err)
+	}
+	c := &hub.Client{Hub: h.Hub, Name: "aa", Topic: stream, Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	if err := h.RegisterWithOptions(ctx, c, ClientOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	feeds := func() []string {
+		s, err := h.Snapshot(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.Streams[stream][0].Feeds
+	}
+
+	if err := h.MuteFeed(ctx, stream, "audio", 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := feeds(); !reflect.DeepEqual(got, []string{"video0"}) {
+		t.Error("wrong feeds while muted", got)
+	}
+
+	// the mute outlasts the rule being replaced
+	if err := h.AddRule(ctx, Rule{Stream: stream, Feeds: []string{"video0", "audio"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := feeds(); !reflect.DeepEqual(got, []string{"video0"}) {
+		t.Error("wrong feeds after rule replaced", got)
+	}
+
+	s, err := h.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Mute{{Feed: "audio"}}; !reflect.DeepEqual(s.Mutes[stream], want) {
+		t.Error("wrong mutes in snapshot", s.Mutes[stream])
+	}
+
+	if err := h.UnmuteFeed(ctx, stream, "audio"); err != nil {
+		t.Fatal(err)
+	}
+	if got := feeds(); !reflect.DeepEqual(got, []string{"audio", "video0"}) {
+		t.Error("wrong feeds after unmute", got)
+	}
+}
+
+func TestInvalidMute(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	stream := "stream/large"
+
+	if err := h.MuteFeed(ctx, stream, "audio", -time.Second); !errors.Is(err, ErrInvalidMute) {
+		t.Error("wanted ErrInvalidMute for negative duration, got", err)
+	}
+	if err := h.MuteFeed(ctx, stream, "", 0); !errors.Is(err, ErrInvalidMute) {
+		t.Error("wanted ErrInvalidMute for empty feed, got", err)
+	}
+	if err := h.UnmuteFeed(ctx, stream, ""); !errors.Is(err, ErrInvalidMute) {
+		t.Error("wanted ErrInvalidMute for empty feed, got", err)
+	}
+
+	s, err := h.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Mutes[stream]) != 0 {
+		t.Error("invalid mute applied", s.Mutes[stream])
+	}
+}
+
+func TestMuteExpires(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	events, err := h.Subscribe(ctx, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// muting in an inner stream also mutes the outer one
+	if err := h.AddRule(ctx, Rule{Stream: "stream/inner", Feeds: []string{"audio"}}); err != nil {
+		t.Fatal(err)
+	}
+	stream := "stream/large"
+	if err := h.AddRule(ctx, Rule{Stream: stream, Feeds: []string{"video0", "stream/inner"}}); err != nil {
+		t.Fatal(err)
+	}
+	c := &hub.Client{Hub: h.Hub, Name: "aa", Topic: stream, Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	if err := h.RegisterWithOptions(ctx, c, ClientOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.MuteFeed(ctx, "stream/inner", "aud*", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := h.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Streams[stream][0].Feeds; !reflect.DeepEqual(got, []string{"video0"}) {
+		t.Error("wrong feeds while muted", got)
+	}
+	if m := s.Mutes["stream/inner"]; len(m) != 1 || m[0].Until.IsZero() {
+		t.Error("wrong mutes in snapshot", m)
+	}
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.Type != FeedUnmuted {
+				continue
+			}
+			if e.Stream != "stream/inner" || e.Feed != "aud*" {
+				t.Error("wrong unmute event", e)
+			}
+		case <-timeout:
+			t.Fatal("mute did not expire")
+		}
+		break
+	}
+
+	s, err = h.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Streams[stream][0].Feeds; !reflect.DeepEqual(got, []string{"audio", "video0"}) {
+		t.Error("wrong feeds after mute expired", got)
+	}
+	if len(s.Mutes) != 0 {
+		t.Error("expired mute in snapshot", s.Mutes)
+	}
+}
@@ -0,0 +1,302 @@
+package agg
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"github.com/timdrysdale/hub"
+)
+
+const (
+	muxProgram  = 1
+	muxPMTPID   = 0x1000
+	muxFirstPID = 0x0100
+	muxLastPID  = 0x1FFE
+)
+
+// muxer combines the MPEG-TS feeds relayed to a stream client into one
+// transport stream, giving each elementary stream its own PID
+type muxer struct {
+	sync.Mutex
+	feeds map[string]*muxFeed
+	// added counts the feeds added, to order their streams
+	added int
+	// source is the feed whose tables are replaced, if any
+	source  *muxFeed
+	nextPID uint16
+	version byte
+	// cc holds the last continuity counter sent on each PID
+	cc map[uint16]byte
+}
+
+type muxFeed struct {
+	order int
+	// pmtPID is 0 until the feed's PAT has been seen
+	pmtPID uint16
+	// waiting is set if the feed has sent a PAT since the source did
+	waiting bool
+	// pcrPID and streams use our PIDs, not the feed's
+	pcrPID  uint16
+	streams []esInfo
+	pids    map[uint16]uint16
+}
+
+func newMuxer() *muxer {
+	return &muxer{
+		feeds:   make(map[string]*muxFeed),
+		nextPID: muxFirstPID,
+		cc:      make(map[uint16]byte),
+	}
+}
+
+// muxerFor returns the muxer for a stream client, making it if need be
+func (h *Hub) muxerFor(client *hub.Client) *muxer {
+
+	if _, ok := h.muxers[client]; !ok {
+		h.muxers[client] = newMuxer()
+	}
+
+	return h.muxers[client]
+}
+
+func (m *muxer) add(feed string) {
+	m.Lock()
+	defer m.Unlock()
+	m.added++
+	m.feeds[feed] = &muxFeed{order: m.added, pids: make(map[uint16]uint16)}
+}
+
+func (m *muxer) remove(feed string) {
+	m.Lock()
+	defer m.Unlock()
+	if m.source == m.feeds[feed] {
+		m.source = nil
+	}
+	delete(m.feeds, feed)
+	m.version++
+}
+
+// remux rewrites a message for a muxed stream, reporting false if
+// nothing is left to send
+func (sc *SubClient) remux(msg hub.Message) (hub.Message, bool) {
+
+	if sc.mux == nil {
+		return msg, true
+	}
+
+	msg.Data = sc.mux.remux(sc.Client.Topic, msg.Data)
+
+	return msg, len(msg.Data) > 0
+}
+
+// remux returns a copy of data with its packets rewritten for the
+// combined stream. The data is shared with other subscribers to the
+// feed, so is not changed.
+func (m *muxer) remux(feed string, data []byte) []byte {
+
+	if !isTransportStream(data) {
+		return data
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	f, ok := m.feeds[feed]
+	if !ok {
+		return data
+	}
+
+	out := make([]byte, 0, len(data))
+
+	for i := 0; i < len(data); i += tsPacketSize {
+
+		p := data[i : i+tsPacketSize]
+		pid := tsPID(p)
+
+		switch {
+		case pid == tsPATPID:
+			if pmt, ok := parsePAT(p); ok {
+				f.pmtPID = pmt
+			}
+			if m.choose(f) {
+				out = append(out, m.pat()...)
+			}
+		case pid == f.pmtPID:
+			if pcr, streams, ok := parsePMT(p); ok {
+				m.update(f, pcr, streams)
+			}
+			if m.source == f {
+				out = append(out, m.pmt()...)
+			}
+		case pid == tsNullPID:
+			// padding is not needed
+		default:
+			out = append(out, p...)
+			m.rewrite(out[len(out)-tsPacketSize:], m.pid(f, pid))
+		}
+	}
+
+	return out
+}
+
+// choose is called for each PAT from a feed, and reports whether the
+// feed is the source, taking over from a source that has gone quiet
+func (m *muxer) choose(f *muxFeed) bool {
+
+	if m.source != nil && m.source != f && !f.waiting {
+		f.waiting = true
+		return false
+	}
+
+	m.source = f
+	for _, other := range m.feeds {
+		other.waiting = false
+	}
+
+	return true
+}
+
+// pid returns our PID for one of a feed's PIDs
+func (m *muxer) pid(f *muxFeed, pid uint16) uint16 {
+
+	if mapped, ok := f.pids[pid]; ok {
+		return mapped
+	}
+
+	mapped := m.nextPID
+
+	m.nextPID++
+	if m.nextPID == muxPMTPID {
+		m.nextPID++
+	}
+	if m.nextPID > muxLastPID {
+		m.nextPID = muxFirstPID
+	}
+
+	f.pids[pid] = mapped
+
+	return mapped
+}
+
+// update records a feed's PMT, changing the version of the combined
+// tables if anything has changed
+func (m *muxer) update(f *muxFeed, pcr uint16, streams []esInfo) {
+
+	mapped := []esInfo{}
+	for _, es := range streams {
+		es.pid = m.pid(f, es.pid)
+		mapped = append(mapped, es)
+	}
+
+	if pcr != tsNullPID {
+		pcr = m.pid(f, pcr)
+	}
+
+	if pcr == f.pcrPID && sameStreams(mapped, f.streams) {
+		return
+	}
+
+	f.pcrPID = pcr
+	f.streams = mapped
+	m.version++
+}
+
+func sameStreams(a, b []esInfo) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].streamType != b[i].streamType || a[i].pid != b[i].pid || !bytes.Equal(a[i].info, b[i].info) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// rewrite gives a packet our PID, and the next continuity counter
+// for that PID if it carries a payload
+func (m *muxer) rewrite(p []byte, pid uint16) {
+
+	p[1] = p[1]&0xE0 | byte(pid>>8)
+	p[2] = byte(pid)
+	p[3] = p[3]&0xF0 | m.next(pid, p[3]&0x10 != 0)
+}
+
+// next returns the continuity counter for a packet on pid, which only
+// goes up for packets with a payload
+func (m *muxer) next(pid uint16, payload bool) byte {
+
+	cc, ok := m.cc[pid]
+
+	switch {
+	case !ok:
+		cc = 0
+	case payload:
+		cc = (cc + 1) & 0x0F
+	}
+
+	m.cc[pid] = cc
+
+	return cc
+}
+
+// pat returns a packet with the combined PAT
+func (m *muxer) pat() []byte {
+
+	body := []byte{
+		byte(muxProgram >> 8), byte(muxProgram),
+		0xE0 | byte(muxPMTPID>>8), byte(muxPMTPID & 0xFF),
+	}
+
+	// transport_stream_id
+	section := psiSection(tsPATTable, 1, m.version, body)
+
+	return psiPacket(tsPATPID, m.next(tsPATPID, true), section)
+}
+
+// pmt returns a packet with the combined PMT, describing the elementary
+// streams of every feed in the order they were added. The PCR comes from
+// the source. Streams that do not fit in one packet are left out.
+func (m *muxer) pmt() []byte {
+
+	feeds := []*muxFeed{}
+	for _, f := range m.feeds {
+		feeds = append(feeds, f)
+	}
+	sort.Slice(feeds, func(i, j int) bool { return feeds[i].order < feeds[j].order })
+
+	pcr := uint16(tsNullPID)
+	if m.source != nil && m.source.pcrPID != 0 {
+		// 0 means the source's PMT has not been seen yet
+		pcr = m.source.pcrPID
+	}
+
+	body := []byte{
+		0xE0 | byte(pcr>>8), byte(pcr),
+		0xF0, 0x00, // no program_info
+	}
+
+	// the section header, body and CRC must fit after the pointer_field
+	room := tsPacketSize - 5 - 8 - 4
+
+	for _, f := range feeds {
+		for _, es := range f.streams {
+			if len(body)+5+len(es.info) > room {
+				continue
+			}
+			body = append(body,
+				es.streamType,
+				0xE0|byte(es.pid>>8), byte(es.pid),
+				0xF0|byte(len(es.info)>>8), byte(len(es.info)))
+			body = append(body, es.info...)
+		}
+	}
+
+	section := psiSection(tsPMTTable, muxProgram, m.version, body)
+
+	return psiPacket(muxPMTPID, m.next(muxPMTPID, true), section)
+}
@@ -0,0 +1,170 @@
+package agg
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/timdrysdale/hub"
+)
+
+// testFeed makes the PAT, PMT and a video and audio packet of a feed
+// that, like every feed from ffmpeg, uses the same PIDs as the others
+func testFeed(cc byte) []byte {
+
+	pat := psiPacket(tsPATPID, cc, psiSection(tsPATTable, 1, 0, []byte{0x00, 0x01, 0xF0, 0x00}))
+
+	body := []byte{0xE1, 0x00, 0xF0, 0x00,
+		0x1B, 0xE1, 0x00, 0xF0, 0x00,
+		0x0F, 0xE1, 0x01, 0xF0, 0x00}
+	pmt := psiPacket(0x1000, cc, psiSection(tsPMTTable, 1, 0, body))
+
+	video := tsPacket(0x100, true)
+	video[3] |= cc
+	audio := tsPacket(0x101, false)
+	audio[3] |= cc
+
+	data := append(pat, pmt...)
+	data = append(data, video...)
+	return append(data, audio...)
+}
+
+func TestMuxer(t *testing.T) {
+
+	m := newMuxer()
+	m.add("cam0")
+	m.add("cam1")
+
+	// the second feed's counters start part way through
+	a := m.remux("cam0", testFeed(0))
+	b := m.remux("cam1", testFeed(7))
+
+	if len(a) != 4*tsPacketSize {
+		t.Fatal("wanted the first feed's tables kept, got", len(a)/tsPacketSize, "packets")
+	}
+	if len(b) != 2*tsPacketSize {
+		t.Fatal("wanted the second feed's tables dropped, got", len(b)/tsPacketSize, "packets")
+	}
+
+	// the first feed's PAT is seen before its PMT, so the PMT has its streams
+	if pmt, _ := parsePAT(a); pmt != muxPMTPID {
+		t.Error("wrong PMT PID in PAT", pmt)
+	}
+
+	pids := map[uint16]bool{}
+	for i := 2 * tsPacketSize; i < len(a); i += tsPacketSize {
+		pids[tsPID(a[i:])] = true
+	}
+	for i := 0; i < len(b); i += tsPacketSize {
+		pids[tsPID(b[i:])] = true
+	}
+	if len(pids) != 4 {
+		t.Error("wanted four distinct PIDs, got", pids)
+	}
+
+	// the next tables describe both feeds
+	a = m.remux("cam0", testFeed(1))
+	pcr, streams, ok := parsePMT(a[tsPacketSize:])
+	if !ok || len(streams) != 4 {
+		t.Fatal("wrong combined PMT", streams, ok)
+	}
+	if pcr != streams[0].pid {
+		t.Error("PCR not from first feed's video", pcr, streams[0].pid)
+	}
+
+	// counters on each PID carry on without gaps
+	b = m.remux("cam1", testFeed(12))
+	for i := 0; i < len(b); i += tsPacketSize {
+		if cc := b[i+3] & 0x0F; cc != 1 {
+			t.Error("wanted continuity counter 1, got", cc)
+		}
+	}
+
+	// messages that are not a transport stream pass through
+	if got := m.remux("cam0", []byte("hello")); string(got) != "hello" {
+		t.Error("non-TS message changed", got)
+	}
+}
+
+func TestMuxerSource(t *testing.T) {
+
+	psi := func(data []byte) int {
+		n := 0
+		for i := 0; i < len(data); i += tsPacketSize {
+			if pid := tsPID(data[i:]); pid == tsPATPID || pid == muxPMTPID {
+				n++
+			}
+		}
+		return n
+	}
+
+	// a data feed attached first never sends tables, so the video's are used
+	m := newMuxer()
+	m.add("data")
+	m.add("video0")
+	if got := m.remux("data", []byte("hello")); string(got) != "hello" {
+		t.Error("data feed changed", got)
+	}
+	if n := psi(m.remux("video0", testFeed(0))); n != 2 {
+		t.Error("wanted the video's tables replaced, got", n, "tables")
+	}
+
+	// a feed attached first but not sending anything is not waited for
+	m = newMuxer()
+	m.add("video0")
+	m.add("audio")
+	if n := psi(m.remux("audio", testFeed(0))); n != 2 {
+		t.Error("wanted the audio's tables replaced while the video is quiet, got", n, "tables")
+	}
+
+	// when the source goes quiet, the next feed to send two PATs takes over
+	if n := psi(m.remux("video0", testFeed(0))); n != 0 {
+		t.Error("wanted the video's tables dropped, got", n, "tables")
+	}
+	if n := psi(m.remux("video0", testFeed(1))); n != 2 {
+		t.Error("wanted the video to take over from the quiet audio, got", n, "tables")
+	}
+	if n := psi(m.remux("audio", testFeed(1))); n != 0 {
+		t.Error("wanted the audio's tables dropped once the video took over, got", n, "tables")
+	}
+}
+
+func TestMuxStream(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	stream := "stream/large"
+	if err := h.AddRule(ctx, Rule{Stream: stream, Feeds: []string{"video0"}, Mux: true}); err != nil {
+		t.Fatal(err)
+	}
+	c := &hub.Client{Hub: h.Hub, Name: "aa", Topic: stream, Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	if err := h.RegisterWithOptions(ctx, c, ClientOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	c1 := &hub.Client{Hub: h.Hub, Name: "1", Topic: "video0", Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	h.Register <- c1
+	time.Sleep(time.Millisecond)
+
+	data := testFeed(3)
+	h.Broadcast <- hub.Message{Data: data, Sender: *c1, Sent: time.Now()}
+
+	select {
+	case msg := <-c.Send:
+		if pmt, ok := parsePAT(msg.Data); !ok || pmt != muxPMTPID {
+			t.Error("stream not muxed")
+		}
+		if msg.Data[3]&0x0F != 0 {
+			t.Error("wanted counters to start from 0")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no message")
+	}
+
+	// the feed's own message is shared, so must not be changed
+	if cc := data[3] & 0x0F; cc != 3 {
+		t.Error("feed's message changed")
+	}
+}
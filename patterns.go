@@ -0,0 +1,197 @@
+package agg
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/timdrysdale/hub"
+)
+
+// A feed in a rule is a pattern if it contains a wildcard. A single *
+// matches any characters within one path segment, so lab3/camera*
+// matches lab3/camera0 but not lab3/camera0/raw. A double ** matches
+// across segments, so lab3/** matches every topic under lab3/.
+func isPattern(feed string) bool {
+	return strings.Contains(feed, "*")
+}
+
+// matchFeed reports whether topic matches the pattern
+func matchFeed(pattern, topic string) bool {
+
+	for len(pattern) > 0 {
+
+		if strings.HasPrefix(pattern, "**") {
+			rest := strings.TrimLeft(pattern, "*")
+			for i := len(topic); i >= 0; i-- {
+				if matchFeed(rest, topic[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if pattern[0] == '*' {
+			rest := pattern[1:]
+			for i := 0; i <= len(topic); i++ {
+				if matchFeed(rest, topic[i:]) {
+					return true
+				}
+				if i < len(topic) && topic[i] == '/' {
+					return false
+				}
+			}
+			return false
+		}
+
+		if len(topic) == 0 || pattern[0] != topic[0] {
+			return false
+		}
+
+		pattern = pattern[1:]
+		topic = topic[1:]
+	}
+
+	return len(topic) == 0
+}
+
+// registerFeed registers a producer directly with the hub, and when it
+// is the first on its topic, attaches the topic to any stream whose
+// rule has a matching pattern
+func (h *Hub) registerFeed(client *hub.Client) {
+
+	h.Hub.Register <- client
+
+	topic := client.Topic
+
+	if _, ok := h.feeds[topic]; !ok {
+		h.feeds[topic] = make(map[*hub.Client]bool)
+	}
+
+	first := len(h.feeds[topic]) == 0
+	h.feeds[topic][client] = true
+
+	if first {
+		h.refreshAll()
+	}
+}
+
+// unregisterFeed unregisters a producer from the hub, and when it is
+// the last on its topic, detaches the topic from any stream that only
+// had it because of a pattern
+func (h *Hub) unregisterFeed(client *hub.Client) {
+
+	h.Hub.Unregister <- client
+
+	topic := client.Topic
+
+	if !h.feeds[topic][client] {
+		return
+	}
+
+	delete(h.feeds[topic], client)
+
+	if len(h.feeds[topic]) > 0 {
+		return
+	}
+
+	delete(h.feeds, topic)
+
+	h.refreshAll()
+}
+
+// refreshAll brings every stream client's feeds into line with its
+// rules, after the set of topics has changed
+func (h *Hub) refreshAll() {
+
+	h.invalidateReplays()
+
+	for client := range h.joined {
+		h.refresh(client)
+	}
+}
+
+// refresh brings a stream client's feeds into line with the rules of
+// its streams. Relays that are still wanted are left running, unless
+// their policy has changed, and new feeds are attached before old
+// ones are detached.
+func (h *Hub) refresh(client *hub.Client) {
+
+	topics, want := h.wanted(client)
+
+	// a relay keeps the policy and stream it started with,
+	// so restart any for which these have changed
+	for subClient := range h.SubClients[client] {
+		stream, ok := want[subClient.Client.Topic]
+		if ok && h.stale(client, subClient, stream) {
+			h.detachFeed(client, subClient)
+		}
+	}
+
+	for _, topic := range topics {
+		if !h.hasFeed(client, topic) {
+			h.attachFeed(client, h.rules[want[topic]], topic)
+		}
+	}
+
+	for subClient := range h.SubClients[client] {
+		if _, ok := want[subClient.Client.Topic]; !ok {
+			h.detachFeed(client, subClient)
+		}
+	}
+}
+
+// stale reports whether a relay no longer matches the options of its
+// client, or the rule of the stream it should now be relayed for
+func (h *Hub) stale(client *hub.Client, subClient *SubClient, stream string) bool {
+	return subClient.stream != stream ||
+		subClient.tagged != h.options[client].Tagged ||
+		(subClient.mux != nil) != h.rules[stream].Mux ||
+		!reflect.DeepEqual(subClient.filters, filtersFor(h.rules[stream], subClient.Client.Topic)) ||
+		!reflect.DeepEqual(subClient.transformConfigs, transformsFor(h.rules[stream], subClient.Client.Topic)) ||
+		subClient.limit != h.limitFor(client, h.rules[stream]) ||
+		subClient.Policy != h.policyFor(client, h.rules[stream])
+}
+
+// wanted lists the topics a stream client should be relayed from, and
+// maps each to the stream it is counted against. A topic is relayed
+// once, however many of the client's streams include it, and counted
+// against the first of them by name.
+func (h *Hub) wanted(client *hub.Client) ([]string, map[string]string) {
+
+	streams := []string{}
+	for stream := range h.joined[client] {
+		streams = append(streams, stream)
+	}
+	sort.Strings(streams)
+
+	topics := []string{}
+	want := make(map[string]string)
+
+	for _, stream := range streams {
+		rule, ok := h.rules[stream]
+		if !ok {
+			continue
+		}
+		for _, topic := range h.resolve(rule) {
+			if _, ok := want[topic]; !ok {
+				want[topic] = stream
+				topics = append(topics, topic)
+			}
+		}
+	}
+
+	return topics, want
+}
+
+// hasFeed reports whether a stream client is relayed from topic
+func (h *Hub) hasFeed(client *hub.Client, topic string) bool {
+
+	for subClient := range h.SubClients[client] {
+		if subClient.Client.Topic == topic {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,93 @@
+package agg
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/timdrysdale/hub"
+)
+
+func TestMatchFeed(t *testing.T) {
+
+	tests := []struct {
+		pattern string
+		topic   string
+		want    bool
+	}{
+		{"lab3/camera*", "lab3/camera0", true},
+		{"lab3/camera*", "lab3/camera", true},
+		{"lab3/camera*", "lab3/camera0/raw", false},
+		{"lab3/camera*", "lab4/camera0", false},
+		{"lab3/*/raw", "lab3/camera0/raw", true},
+		{"lab3/*/raw", "lab3/camera0/x/raw", false},
+		{"lab3/**", "lab3/camera0/raw", true},
+		{"lab3/**", "lab4/camera0", false},
+		{"**/audio", "lab3/bench1/audio", true},
+		{"**/audio", "lab3/bench1/audio1", false},
+		{"video0", "video0", true},
+	}
+
+	for _, test := range tests {
+		if got := matchFeed(test.pattern, test.topic); got != test.want {
+			t.Errorf("matchFeed(%q, %q): wanted %v got %v", test.pattern, test.topic, test.want, got)
+		}
+	}
+}
+
+func TestPatternFeedsFollowProducers(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	stream := "stream/lab3"
+	if err := h.AddRule(ctx, Rule{Stream: stream, Feeds: []string{"lab3/camera*", "audio"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &hub.Client{Hub: h.Hub, Name: "aa", Topic: stream, Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	h.Register <- c
+
+	cam0 := &hub.Client{Hub: h.Hub, Name: "cam0", Topic: "lab3/camera0", Send: make(chan hub.Message)}
+	cam1 := &hub.Client{Hub: h.Hub, Name: "cam1", Topic: "lab3/camera1", Send: make(chan hub.Message)}
+	other := &hub.Client{Hub: h.Hub, Name: "other", Topic: "lab4/camera0", Send: make(chan hub.Message)}
+
+	feeds := func() []string {
+		s, err := h.Snapshot(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.Streams[stream][0].Feeds
+	}
+
+	if got := feeds(); !reflect.DeepEqual(got, []string{"audio"}) {
+		t.Error("wanted only literal feed before producers register, got", got)
+	}
+
+	h.Register <- cam0
+	h.Register <- cam1
+	h.Register <- other
+
+	if got := feeds(); !reflect.DeepEqual(got, []string{"audio", "lab3/camera0", "lab3/camera1"}) {
+		t.Error("wanted matching cameras attached, got", got)
+	}
+
+	h.Unregister <- cam0
+
+	if got := feeds(); !reflect.DeepEqual(got, []string{"audio", "lab3/camera1"}) {
+		t.Error("wanted camera0 detached, got", got)
+	}
+
+	// a stream client joining later gets the topics that exist now
+	c2 := &hub.Client{Hub: h.Hub, Name: "bb", Topic: stream, Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	h.Register <- c2
+
+	s, err := h.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Streams[stream][1].Feeds; !reflect.DeepEqual(got, []string{"audio", "lab3/camera1"}) {
+		t.Error("wanted late joiner on existing topics, got", got)
+	}
+}
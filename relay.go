@@ -0,0 +1,393 @@
+package agg
+
+import (
+	"errors"
+	"time"
+
+	"github.com/timdrysdale/hub"
+)
+
+// RelayMode selects what a relay does when its stream client
+// is not ready for the next message
+type RelayMode string
+
+const (
+	// RelayBlock waits for the stream client, which may cause the
+	// inner hub to drop the subclient if the wait is long (default)
+	RelayBlock RelayMode = "block"
+	// RelayDropNewest buffers messages, and discards incoming
+	// messages while the buffer is full
+	RelayDropNewest RelayMode = "dropNewest"
+	// RelayDropOldest buffers messages, and discards the oldest
+	// buffered message to make room for an incoming one
+	RelayDropOldest RelayMode = "dropOldest"
+	// RelayDisconnect waits up to Timeout for the stream client,
+	// then unregisters it and closes its Send channel
+	RelayDisconnect RelayMode = "disconnect"
+	// RelayKeyframe buffers MPEG-TS messages, and when the buffer is
+	// full, discards incoming messages until the next one that has a
+	// random access point, so the stream client sees no broken pictures
+	RelayKeyframe RelayMode = "keyframe"
+)
+
+const (
+	DefaultRelayBuffer  = 16
+	DefaultRelayTimeout = time.Second
+)
+
+var ErrInvalidPolicy = errors.New("invalid relay policy")
+
+// RelayPolicy sets how messages are relayed from feeds to a stream
+// client. The zero value blocks.
+type RelayPolicy struct {
+	Mode RelayMode `json:"mode,omitempty"`
+	// Size is the buffer length for the drop and keyframe modes, and
+	// of every relay's channel from the inner hub
+	Size int `json:"size,omitempty"`
+	// Timeout is how long RelayDisconnect waits
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+func (p RelayPolicy) validate() error {
+
+	switch p.Mode {
+	case "", RelayBlock, RelayDropNewest, RelayDropOldest, RelayDisconnect, RelayKeyframe:
+	default:
+		return ErrInvalidPolicy
+	}
+
+	if p.Size < 0 || p.Timeout < 0 {
+		return ErrInvalidPolicy
+	}
+
+	return nil
+}
+
+// eviction asks the run loop to disconnect a stream client, or if
+// lost is set, to restart a relay whose subclient the inner hub dropped
+type eviction struct {
+	client    *hub.Client
+	subClient *SubClient
+	lost      bool
+}
+
+// relay messages from subClient to Client
+func (sc *SubClient) RelayTo(c *hub.Client) {
+
+	// relayBuffered waits for the rate limit, whatever the mode
+	if sc.limiter != nil {
+		sc.relayBuffered(c)
+		return
+	}
+
+	switch sc.Policy.Mode {
+	case RelayDropNewest, RelayDropOldest, RelayKeyframe:
+		sc.relayBuffered(c)
+	case RelayDisconnect:
+		sc.relayWithTimeout(c)
+	default:
+		sc.relayBlocking(c)
+	}
+}
+
+func (sc *SubClient) relayBlocking(c *hub.Client) {
+
+	send := sc.sendTo(c)
+
+	// relay returns false once the relay is stopped
+	relay := func(msg hub.Message) bool {
+		for _, msg := range sc.prepare(msg) {
+			select {
+			case send <- msg:
+				sc.delivered(msg)
+			case sc.tagged <- sc.tag(msg):
+				sc.delivered(msg)
+			case <-sc.Stopped:
+				return false
+			}
+		}
+		return true
+	}
+
+	if !sc.replayTo(c, send, 0) {
+		return
+	}
+
+	for {
+		select {
+		case <-sc.Stopped:
+			return
+		case msg, ok := <-sc.Client.Send:
+			if !ok {
+				sc.lose(c)
+				return
+			}
+			sc.received++
+			if !relay(msg) {
+				return
+			}
+		}
+	}
+}
+
+// relayBuffered holds messages in a ring buffer until the stream
+// client is ready, and is also used by rate limited relays
+func (sc *SubClient) relayBuffered(c *hub.Client) {
+
+	size := sc.Policy.Size
+	if size == 0 {
+		size = DefaultRelayBuffer
+	}
+
+	timeout := time.Duration(0)
+	dropping := false
+
+	switch sc.Policy.Mode {
+	case RelayDropNewest, RelayDropOldest, RelayKeyframe:
+		dropping = true
+	case RelayDisconnect:
+		timeout = sc.Policy.Timeout
+		if timeout == 0 {
+			timeout = DefaultRelayTimeout
+		}
+	}
+
+	replay := []hub.Message{}
+	for _, msg := range sc.takeReplay() {
+		replay = append(replay, sc.prepare(msg)...)
+	}
+
+	// without dropping, the replay must fit as well
+	if !dropping {
+		size += len(replay)
+	}
+
+	buf := newRing(size)
+	send := sc.sendTo(c)
+
+	// set when the keyframe mode has dropped a message, so that
+	// everything up to the next random access point must go too
+	skipping := false
+
+	push := func(msg hub.Message) {
+		if sc.Policy.Mode == RelayKeyframe {
+			if (skipping && !isRandomAccess(msg.Data)) || buf.full() {
+				sc.drop()
+				skipping = true
+				return
+			}
+			skipping = false
+			buf.push(msg)
+			return
+		}
+		if buf.full() {
+			sc.drop()
+			if sc.Policy.Mode == RelayDropNewest {
+				return
+			}
+			buf.pop()
+		}
+		buf.push(msg)
+	}
+
+	for _, msg := range replay {
+		push(msg)
+	}
+
+	// ready is when the next message was first allowed by the rate limit
+	var ready time.Time
+
+	for {
+		// only offer a message when there is one to send, and the
+		// rate limit allows it, else try again once it will
+		var out chan hub.Message
+		var tagged chan<- TaggedMessage
+		var retry, expired <-chan time.Time
+		var next hub.Message
+		if buf.len() > 0 {
+			next = buf.peek()
+			if d := sc.limiter.delay(len(next.Data)); d > 0 {
+				retry = time.After(d)
+				ready = time.Time{}
+			} else {
+				out = send
+				tagged = sc.tagged
+				if ready.IsZero() {
+					ready = time.Now()
+				}
+				if timeout > 0 {
+					expired = time.After(timeout - time.Since(ready))
+				}
+			}
+		}
+
+		in := sc.Client.Send
+		if !dropping && buf.full() {
+			in = nil
+		}
+
+		select {
+		case <-sc.Stopped:
+			return
+		case msg, ok := <-in:
+			if !ok {
+				sc.lose(c)
+				return
+			}
+			sc.received++
+			for _, msg := range sc.prepare(msg) {
+				push(msg)
+			}
+		case out <- next:
+			sc.limiter.take(len(next.Data))
+			sc.delivered(buf.pop())
+			ready = time.Time{}
+		case tagged <- sc.tag(next):
+			sc.limiter.take(len(next.Data))
+			sc.delivered(buf.pop())
+			ready = time.Time{}
+		case <-retry:
+		case <-expired:
+			sc.drop()
+			select {
+			case sc.evict <- eviction{client: c, subClient: sc}:
+			case <-sc.Stopped:
+			}
+			return
+		}
+	}
+}
+
+// relayWithTimeout evicts the stream client if it does not take
+// a message within the timeout
+func (sc *SubClient) relayWithTimeout(c *hub.Client) {
+
+	timeout := sc.Policy.Timeout
+	if timeout == 0 {
+		timeout = DefaultRelayTimeout
+	}
+
+	send := sc.sendTo(c)
+
+	// relay returns false once the relay is stopped, or has
+	// asked for the stream client to be evicted
+	relay := func(msg hub.Message) bool {
+		for _, msg := range sc.prepare(msg) {
+			timer := time.NewTimer(timeout)
+			select {
+			case send <- msg:
+				timer.Stop()
+				sc.delivered(msg)
+			case sc.tagged <- sc.tag(msg):
+				timer.Stop()
+				sc.delivered(msg)
+			case <-timer.C:
+				sc.drop()
+				select {
+				case sc.evict <- eviction{client: c, subClient: sc}:
+				case <-sc.Stopped:
+				}
+				return false
+			case <-sc.Stopped:
+				timer.Stop()
+				return false
+			}
+		}
+		return true
+	}
+
+	if !sc.replayTo(c, send, timeout) {
+		return
+	}
+
+	for {
+		select {
+		case <-sc.Stopped:
+			return
+		case msg, ok := <-sc.Client.Send:
+			if !ok {
+				sc.lose(c)
+				return
+			}
+			sc.received++
+			if !relay(msg) {
+				return
+			}
+		}
+	}
+}
+
+// lose tells the run loop that the inner hub has closed the
+// subclient's Send, which it does if the relay was not ready for a
+// message, unless the relay is being stopped anyway
+func (sc *SubClient) lose(c *hub.Client) {
+
+	select {
+	case sc.evict <- eviction{client: c, subClient: sc, lost: true}:
+	case <-sc.Stopped:
+	}
+}
+
+// prepare filters, decimates, transforms and muxes a message from the
+// feed, returning what is left to send to the stream client
+func (sc *SubClient) prepare(msg hub.Message) []hub.Message {
+
+	if !sc.pass(msg) {
+		return nil
+	}
+
+	if !sc.decimate() {
+		sc.drop()
+		return nil
+	}
+
+	msgs := []hub.Message{msg}
+	if len(sc.transforms) > 0 {
+		msgs = sc.transform(msg)
+	}
+
+	out := msgs[:0]
+	for _, msg := range msgs {
+		if msg, ok := sc.remux(msg); ok {
+			out = append(out, msg)
+		}
+	}
+
+	return out
+}
+
+// ring is a fixed size FIFO of messages
+type ring struct {
+	msgs []hub.Message
+	head int
+	n    int
+}
+
+func newRing(size int) *ring {
+	return &ring{msgs: make([]hub.Message, size)}
+}
+
+func (r *ring) len() int {
+	return r.n
+}
+
+func (r *ring) full() bool {
+	return r.n == len(r.msgs)
+}
+
+func (r *ring) push(msg hub.Message) {
+	r.msgs[(r.head+r.n)%len(r.msgs)] = msg
+	r.n++
+}
+
+func (r *ring) peek() hub.Message {
+	return r.msgs[r.head]
+}
+
+func (r *ring) pop() hub.Message {
+	msg := r.msgs[r.head]
+	r.msgs[r.head] = hub.Message{}
+	r.head = (r.head + 1) % len(r.msgs)
+	r.n--
+	return msg
+}
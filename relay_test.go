@@ -0,0 +1,285 @@
+package agg
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/timdrysdale/hub"
+)
+
+func newTestSubClient(policy RelayPolicy) *SubClient {
+	return &SubClient{
+		Client:   &hub.Client{Send: make(chan hub.Message)},
+		Stopped:  make(chan struct{}),
+		Policy:   policy,
+		counters: &relayCounters{},
+	}
+}
+
+func TestRelayDropModes(t *testing.T) {
+
+	tests := []struct {
+		mode RelayMode
+		want []byte
+	}{
+		{RelayDropNewest, []byte{0, 1}},
+		{RelayDropOldest, []byte{3, 4}},
+	}
+
+	for _, test := range tests {
+		sc := newTestSubClient(RelayPolicy{Mode: test.mode, Size: 2})
+		c := &hub.Client{Send: make(chan hub.Message)}
+		go sc.RelayTo(c)
+
+		// nobody is reading c.Send, but the relay must keep accepting
+		for i := 0; i < 5; i++ {
+			select {
+			case sc.Client.Send <- hub.Message{Data: []byte{byte(i)}}:
+			case <-time.After(time.Second):
+				t.Fatal(test.mode, "relay blocked")
+			}
+		}
+
+		for _, want := range test.want {
+			msg := <-c.Send
+			if msg.Data[0] != want {
+				t.Error(test.mode, "wanted message", want, "got", msg.Data[0])
+			}
+		}
+
+		if dropped := atomic.LoadUint64(&sc.counters.dropped); dropped != 3 {
+			t.Error(test.mode, "wanted 3 dropped, got", dropped)
+		}
+
+		close(sc.Stopped)
+	}
+}
+
+func TestRelayKeyframe(t *testing.T) {
+
+	sc := newTestSubClient(RelayPolicy{Mode: RelayKeyframe, Size: 2})
+	c := &hub.Client{Send: make(chan hub.Message)}
+	go sc.RelayTo(c)
+	defer close(sc.Stopped)
+
+	key := tsPacket(0x100, true)
+	delta := tsPacket(0x100, false)
+
+	// the third message overflows the buffer, so the fourth must go
+	// too because it depends on it; the fifth is the next keyframe
+	in := [][]byte{key, delta, delta, delta, key, delta}
+	for i, data := range in {
+		data = append([]byte(nil), data...)
+		data[2] = byte(i) // tag each packet so we can tell them apart
+		sc.Client.Send <- hub.Message{Data: data}
+		if i == 3 {
+			// let the buffer drain
+			for j := 0; j < 2; j++ {
+				if msg := <-c.Send; msg.Data[2] != byte(j) {
+					t.Error("wanted message", j, "got", msg.Data[2])
+				}
+			}
+		}
+	}
+
+	for _, want := range []byte{4, 5} {
+		if msg := <-c.Send; msg.Data[2] != want {
+			t.Error("wanted message", want, "got", msg.Data[2])
+		}
+	}
+
+	if dropped := atomic.LoadUint64(&sc.counters.dropped); dropped != 2 {
+		t.Error("wanted 2 dropped, got", dropped)
+	}
+}
+
+func TestRelayDisconnect(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	stream := "stream/large"
+	if err := h.AddRule(ctx, Rule{Stream: stream, Feeds: []string{"video0"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := &RelayPolicy{Mode: RelayDisconnect, Timeout: time.Millisecond}
+	c := &hub.Client{Hub: h.Hub, Name: "aa", Topic: stream, Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	if err := h.RegisterWithOptions(ctx, c, ClientOptions{Policy: policy}); err != nil {
+		t.Fatal(err)
+	}
+
+	c1 := &hub.Client{Hub: h.Hub, Name: "1", Topic: "video0", Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	h.Register <- c1
+
+	time.Sleep(time.Millisecond)
+	h.Broadcast <- hub.Message{Data: []byte{'t'}, Sender: *c1, Sent: time.Now()}
+
+	// c does not read its messages, so is disconnected
+	deadline := time.Now().Add(time.Second)
+	for {
+		s, err := h.Snapshot(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(s.Streams[stream]) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("client not disconnected")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, ok := <-c.Send; ok {
+		t.Error("wanted Send closed, got message")
+	}
+}
+
+func TestRelayRestart(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	stream := "stream/large"
+	rule := Rule{Stream: stream, Feeds: []string{"video0"}, Policy: &RelayPolicy{Size: 1}}
+	if err := h.AddRule(ctx, rule); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &hub.Client{Hub: h.Hub, Name: "aa", Topic: stream, Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	h.Register <- c
+
+	c1 := &hub.Client{Hub: h.Hub, Name: "1", Topic: "video0", Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	h.Register <- c1
+
+	time.Sleep(time.Millisecond)
+
+	// the relay blocks on the first message, and the second fills
+	// its channel, so the inner hub drops the subclient at the third
+	for _, b := range []byte{0, 1, 2} {
+		h.Broadcast <- hub.Message{Data: []byte{b}, Sender: *c1}
+		time.Sleep(time.Millisecond)
+	}
+
+	for _, want := range []byte{0, 1} {
+		if msg := <-c.Send; msg.Data[0] != want {
+			t.Error("wanted", want, "got", msg.Data[0])
+		}
+	}
+
+	// the feed is restarted, with the lost message counted
+	deadline := time.Now().Add(time.Second)
+	for {
+		stats, err := h.StreamStats(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats[stream].Feeds["video0"].Dropped == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("lost message not counted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	h.Broadcast <- hub.Message{Data: []byte{3}, Sender: *c1}
+
+	select {
+	case msg := <-c.Send:
+		if msg.Data[0] != 3 {
+			t.Error("wanted fourth message, got", msg.Data[0])
+		}
+	case <-time.After(time.Second):
+		t.Fatal("feed not restarted")
+	}
+}
+
+func TestRelayBurst(t *testing.T) {
+
+	// a small channel from the inner hub lets it drop the subclient,
+	// so that messages are lost while the feed is restarted
+	for _, policy := range []RelayPolicy{{Mode: RelayDropOldest}, {Mode: RelayBlock, Size: 1}} {
+
+		h := New()
+		ctx, cancel := context.WithCancel(context.Background())
+		go h.RunContext(ctx)
+
+		stream := "stream/large"
+		policy := policy
+		rule := Rule{Stream: stream, Feeds: []string{"video0"}, Policy: &policy}
+		if err := h.AddRule(ctx, rule); err != nil {
+			t.Fatal(err)
+		}
+
+		c := &hub.Client{Hub: h.Hub, Name: "aa", Topic: stream, Send: make(chan hub.Message, 16), Stats: hub.NewClientStats()}
+		h.Register <- c
+
+		// the stream client pauses now and then, so the relay falls
+		// behind while the messages keep coming
+		go func() {
+			for i := 1; ; i++ {
+				select {
+				case <-c.Send:
+					if i%100 == 0 {
+						time.Sleep(time.Millisecond)
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+
+		c1 := &hub.Client{Hub: h.Hub, Name: "1", Topic: "video0", Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+		h.Register <- c1
+
+		time.Sleep(time.Millisecond)
+
+		// sent back to back, so the relay may fall behind the inner hub,
+		// but every message is either delivered or counted as dropped
+		sent := uint64(20000)
+		for i := uint64(0); i < sent; i++ {
+			h.Broadcast <- hub.Message{Data: []byte{byte(i)}, Sender: *c1}
+		}
+
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			stats, err := h.StreamStats(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := stats[stream].Feeds["video0"]
+			if got.Messages+got.Dropped == sent {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal(policy.Mode, "wanted", sent, "delivered or dropped, got", got.Messages, "delivered and", got.Dropped, "dropped")
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		cancel()
+	}
+}
+
+func TestInvalidPolicy(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	rule := Rule{Stream: "stream/large", Feeds: []string{"video0"}, Policy: &RelayPolicy{Mode: "sometimes"}}
+	if err := h.AddRule(ctx, rule); err == nil {
+		t.Error("rule with invalid policy accepted")
+	}
+
+	c := &hub.Client{Hub: h.Hub, Name: "aa", Topic: "stream/large", Send: make(chan hub.Message)}
+	if err := h.RegisterWithOptions(ctx, c, ClientOptions{Policy: &RelayPolicy{Size: -1}}); err != ErrInvalidPolicy {
+		t.Error("wanted ErrInvalidPolicy, got", err)
+	}
+}
@@ -0,0 +1,247 @@
+package agg
+
+import (
+	"errors"
+	"time"
+
+	"github.com/timdrysdale/hub"
+)
+
+const DefaultReplayMessages = 256
+
+var ErrInvalidReplay = errors.New("replay must keep some messages, and not a negative number or age")
+
+// Replay sets which of a feed's recent messages are kept and sent to
+// clients joining the stream. Messages is DefaultReplayMessages if not
+// set, so that the cache is bounded.
+type Replay struct {
+	// Messages is the most messages kept for each feed
+	Messages int `json:"messages,omitempty"`
+	// Age is how long a message is kept
+	Age time.Duration `json:"age,omitempty"`
+	// Keyframe keeps only the messages since the last MPEG-TS random
+	// access point; for any other data, that is just the last message
+	Keyframe bool `json:"keyframe,omitempty"`
+}
+
+func (r Replay) validate() error {
+
+	if r.Messages < 0 || r.Age < 0 || (r.Messages == 0 && r.Age == 0 && !r.Keyframe) {
+		return ErrInvalidReplay
+	}
+
+	return nil
+}
+
+type replayCache struct {
+	replay  Replay
+	entries []replayEntry
+}
+
+type replayEntry struct {
+	msg hub.Message
+	at  time.Time
+}
+
+// bounded returns the replay with the default number of messages, if
+// none is set
+func (r Replay) bounded() Replay {
+
+	if r.Messages == 0 {
+		r.Messages = DefaultReplayMessages
+	}
+
+	return r
+}
+
+func (c *replayCache) add(msg hub.Message, now time.Time) {
+
+	if c.replay.Keyframe && isRandomAccess(msg.Data) {
+		c.entries = nil
+	}
+
+	c.entries = append(c.entries, replayEntry{msg: msg, at: now})
+	c.trim(now)
+}
+
+// trim drops the messages that are too many or too old, and in
+// keyframe mode, any left before the first random access point
+func (c *replayCache) trim(now time.Time) {
+
+	n := 0
+
+	if len(c.entries) > c.replay.Messages {
+		n = len(c.entries) - c.replay.Messages
+	}
+
+	if c.replay.Age > 0 {
+		for n < len(c.entries) && now.Sub(c.entries[n].at) > c.replay.Age {
+			n++
+		}
+	}
+
+	if c.replay.Keyframe {
+		for n < len(c.entries) && !isRandomAccess(c.entries[n].msg.Data) {
+			n++
+		}
+	}
+
+	c.entries = c.entries[n:]
+}
+
+// messages returns the messages to replay, oldest first
+func (c *replayCache) messages(now time.Time) []hub.Message {
+
+	c.trim(now)
+
+	msgs := []hub.Message{}
+	for _, e := range c.entries {
+		msgs = append(msgs, e.msg)
+	}
+
+	return msgs
+}
+
+// cache keeps a broadcast message for replay, in each stream whose
+// rule asks for it and that has the message's feed
+func (h *Hub) cache(msg hub.Message) {
+
+	if h.replayIndex == nil {
+		h.indexReplays()
+	}
+
+	caches := h.replayIndex[msg.Sender.Topic]
+	if len(caches) == 0 {
+		return
+	}
+
+	now := h.clock().Now()
+	for _, c := range caches {
+		c.add(msg, now)
+	}
+}
+
+// indexReplays finds the caches each feed's messages are kept in,
+// keeping those that are still wanted, with the messages they hold
+func (h *Hub) indexReplays() {
+
+	replays := make(map[string]map[string]*replayCache)
+	h.replayIndex = make(map[string][]*replayCache)
+
+	for stream, rule := range h.rules {
+
+		if rule.Replay == nil {
+			continue
+		}
+
+		replay := rule.Replay.bounded()
+		replays[stream] = make(map[string]*replayCache)
+
+		for _, topic := range h.resolve(rule) {
+			c, ok := h.replays[stream][topic]
+			if !ok || c.replay != replay {
+				c = &replayCache{replay: replay}
+			}
+			replays[stream][topic] = c
+			h.replayIndex[topic] = append(h.replayIndex[topic], c)
+		}
+	}
+
+	h.replays = replays
+}
+
+// invalidateReplays is called when the feeds of a stream may have
+// changed, so the caches are found again on the next broadcast
+func (h *Hub) invalidateReplays() {
+	h.replayIndex = nil
+}
+
+// replayFor returns the messages to replay to a new relay
+func (h *Hub) replayFor(stream, feed string) []hub.Message {
+
+	c, ok := h.replays[stream][feed]
+	if !ok {
+		return nil
+	}
+
+	return c.messages(h.clock().Now())
+}
+
+// replayTo sends the replay for the unbuffered policies, queueing live
+// messages meanwhile, and returns false if the relay is to stop
+func (sc *SubClient) replayTo(c *hub.Client, send chan hub.Message, timeout time.Duration) bool {
+
+	queue := []hub.Message{}
+	for _, msg := range sc.takeReplay() {
+		queue = append(queue, sc.prepare(msg)...)
+	}
+
+	size := sc.Policy.Size
+	if size == 0 {
+		size = DefaultRelayBuffer
+	}
+	limit := len(queue) + size
+
+	var timer *time.Timer
+	var expired <-chan time.Time
+
+	stop := func() {
+		if timer != nil {
+			timer.Stop()
+			timer, expired = nil, nil
+		}
+	}
+	defer stop()
+
+	for len(queue) > 0 {
+
+		if timeout > 0 && timer == nil {
+			timer = time.NewTimer(timeout)
+			expired = timer.C
+		}
+
+		select {
+		case <-sc.Stopped:
+			return false
+		case msg, ok := <-sc.Client.Send:
+			if !ok {
+				sc.lose(c)
+				return false
+			}
+			sc.received++
+			for _, msg := range sc.prepare(msg) {
+				if len(queue) >= limit {
+					sc.drop()
+					continue
+				}
+				queue = append(queue, msg)
+			}
+		case send <- queue[0]:
+			sc.delivered(queue[0])
+			queue = queue[1:]
+			stop()
+		case sc.tagged <- sc.tag(queue[0]):
+			sc.delivered(queue[0])
+			queue = queue[1:]
+			stop()
+		case <-expired:
+			sc.drop()
+			select {
+			case sc.evict <- eviction{client: c, subClient: sc}:
+			case <-sc.Stopped:
+			}
+			return false
+		}
+	}
+
+	return true
+}
+
+// takeReplay returns the messages to replay, once
+func (sc *SubClient) takeReplay() []hub.Message {
+
+	msgs := sc.replay
+	sc.replay = nil
+
+	return msgs
+}
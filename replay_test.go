@@ -0,0 +1,170 @@
+package agg
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/timdrysdale/hub"
+)
+
+func TestReplayCache(t *testing.T) {
+
+	now := time.Now()
+
+	data := func(msgs []hub.Message) []string {
+		s := []string{}
+		for _, msg := range msgs {
+			s = append(s, string(msg.Data))
+		}
+		return s
+	}
+
+	c := &replayCache{replay: Replay{Messages: 3}.bounded()}
+	for i := 0; i < 5; i++ {
+		c.add(hub.Message{Data: []byte(strconv.Itoa(i))}, now)
+	}
+	if got := data(c.messages(now)); len(got) != 3 || got[0] != "2" || got[2] != "4" {
+		t.Error("wanted the last three messages, got", got)
+	}
+
+	c = &replayCache{replay: Replay{Age: time.Second}.bounded()}
+	c.add(hub.Message{Data: []byte("old")}, now)
+	c.add(hub.Message{Data: []byte("new")}, now.Add(time.Second))
+	if got := data(c.messages(now.Add(1500 * time.Millisecond))); len(got) != 1 || got[0] != "new" {
+		t.Error("wanted only the message under a second old, got", got)
+	}
+
+	c = &replayCache{replay: Replay{Keyframe: true}.bounded()}
+	for _, key := range []bool{false, true, false, false, true, false} {
+		c.add(hub.Message{Data: tsPacket(0x100, key)}, now)
+	}
+	if got := c.messages(now); len(got) != 2 || !isRandomAccess(got[0].Data) {
+		t.Error("wanted the messages since the last keyframe, got", len(got))
+	}
+}
+
+func TestInvalidReplay(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	for _, r := range []Replay{{}, {Messages: -1}, {Age: -time.Second}} {
+		r := r
+		rule := Rule{Stream: "stream/data", Feeds: []string{"data"}, Replay: &r}
+		if err := h.AddRule(ctx, rule); !errors.Is(err, ErrInvalidReplay) {
+			t.Error("wanted ErrInvalidReplay, got", err)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	stream := "stream/data"
+	rule := Rule{Stream: stream, Feeds: []string{"data"}, Replay: &Replay{Messages: 2}}
+	if err := h.AddRule(ctx, rule); err != nil {
+		t.Fatal(err)
+	}
+
+	c1 := &hub.Client{Hub: h.Hub, Name: "1", Topic: "data", Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	h.Register <- c1
+	time.Sleep(time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		h.Broadcast <- hub.Message{Sender: *c1, Data: []byte(strconv.Itoa(i))}
+	}
+
+	c := &hub.Client{Hub: h.Hub, Name: "aa", Topic: stream, Send: make(chan hub.Message, 8), Stats: hub.NewClientStats()}
+	if err := h.RegisterWithOptions(ctx, c, ClientOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the hub drops subclients that are not ready for the next message
+	time.Sleep(time.Millisecond)
+	h.Broadcast <- hub.Message{Sender: *c1, Data: []byte("3")}
+
+	for _, want := range []string{"1", "2", "3"} {
+		select {
+		case msg := <-c.Send:
+			if string(msg.Data) != want {
+				t.Error("wanted", want, "got", string(msg.Data))
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no message")
+		}
+	}
+
+	// registering again does not replay the feed the client already has
+	if err := h.JoinStream(ctx, c, stream, ClientOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-c.Send:
+		t.Error("unexpected message", string(msg.Data))
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestReplayWhileLive(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	stream := "stream/data"
+	rule := Rule{Stream: stream, Feeds: []string{"data"}, Replay: &Replay{Messages: 100}}
+	if err := h.AddRule(ctx, rule); err != nil {
+		t.Fatal(err)
+	}
+
+	c1 := &hub.Client{Hub: h.Hub, Name: "1", Topic: "data", Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	h.Register <- c1
+
+	for i := 0; i < 100; i++ {
+		h.Broadcast <- hub.Message{Sender: *c1, Data: []byte(strconv.Itoa(i))}
+	}
+
+	// with the default blocking policy, the relay is still replaying
+	// to c, which is not reading yet, when the live messages arrive
+	c := &hub.Client{Hub: h.Hub, Name: "aa", Topic: stream, Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	if err := h.RegisterWithOptions(ctx, c, ClientOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// c reads nothing until every live message is sent, so they all
+	// arrive during the replay; the sleeps only pace the hub, which
+	// drops subclients that are not ready for the next message
+	time.Sleep(time.Millisecond)
+
+	for i := 100; i < 110; i++ {
+		h.Broadcast <- hub.Message{Sender: *c1, Data: []byte(strconv.Itoa(i))}
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i < 110; i++ {
+		select {
+		case msg := <-c.Send:
+			if string(msg.Data) != strconv.Itoa(i) {
+				t.Fatal("wanted", i, "got", string(msg.Data))
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no message", i)
+		}
+	}
+
+	stats, err := h.StreamStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stats[stream].Feeds["data"]; got.Dropped != 0 || got.Messages != 110 {
+		t.Error("wanted 110 messages and none dropped, got", got)
+	}
+}
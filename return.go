@@ -0,0 +1,20 @@
+package agg
+
+import (
+	"github.com/timdrysdale/hub"
+)
+
+// broadcastReturn sends a message from a stream client to each feed in
+// the return path of the stream's rule, as if the client were on that
+// feed. The inner hub does not echo a message to clients with the
+// sender's name, so the stream client's own subclients do not get it
+// back, but anything else on the feed does, including other streams.
+func (h *Hub) broadcastReturn(msg hub.Message, rule Rule) {
+
+	for _, feed := range rule.Return {
+		m := msg
+		m.Sender.Topic = feed
+		h.offer(m)
+		h.Hub.Broadcast <- m
+	}
+}
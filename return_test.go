@@ -0,0 +1,68 @@
+package agg
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/timdrysdale/hub"
+)
+
+func TestReturnPath(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	stream := "stream/large"
+	rule := Rule{Stream: stream, Feeds: []string{"video0"}, Return: []string{"control"}}
+	if err := h.AddRule(ctx, rule); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &hub.Client{Hub: h.Hub, Name: "aa", Topic: stream, Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	h.Register <- c
+
+	// buffered so the inner hub need not wait for us
+	video := &hub.Client{Hub: h.Hub, Name: "video", Topic: "video0", Send: make(chan hub.Message, 1)}
+	control := &hub.Client{Hub: h.Hub, Name: "control", Topic: "control", Send: make(chan hub.Message, 1)}
+	h.Register <- video
+	h.Register <- control
+
+	h.Broadcast <- hub.Message{Data: []byte("start"), Sender: *c, Sent: time.Now()}
+
+	select {
+	case msg := <-control.Send:
+		if string(msg.Data) != "start" {
+			t.Error("wrong data on control feed", string(msg.Data))
+		}
+		if msg.Sender.Name != c.Name {
+			t.Error("wrong sender on control feed", msg.Sender.Name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("control feed did not get message from stream")
+	}
+
+	select {
+	case <-video.Send:
+		t.Error("feed not in return path got message from stream")
+	case <-c.Send:
+		t.Error("stream client got its own message back")
+	case <-time.After(5 * time.Millisecond):
+	}
+}
+
+func TestReturnPathInvalid(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	for _, ret := range []string{"stream/other", "lab3/*", ""} {
+		rule := Rule{Stream: "stream/large", Feeds: []string{"video0"}, Return: []string{ret}}
+		if err := h.AddRule(ctx, rule); !errors.Is(err, ErrInvalidReturn) {
+			t.Errorf("return %q: wanted ErrInvalidReturn, got %v", ret, err)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package agg
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// DeleteAll is the reserved stream name that, when sent on
+// Hub.Delete, removes every rule. It cannot be used as a stream.
+const DeleteAll = "deleteAll"
+
+// streamPrefix is the namespace that separates streams from feeds
+const streamPrefix = "stream/"
+
+var (
+	ErrReservedName  = errors.New("stream name is reserved")
+	ErrInvalidPrefix = errors.New("stream name must start with " + streamPrefix)
+	ErrEmptyFeeds    = errors.New("rule has no feeds")
+	ErrHubClosed     = errors.New("hub is not running")
+	ErrInvalidReturn = errors.New("return path must name feeds, not streams or patterns")
+	ErrVersion       = errors.New("rule version does not match")
+)
+
+// RuleError reports which stream a rejected rule operation was for.
+// Use errors.Is to compare Err with the Err* values above.
+type RuleError struct {
+	Stream string
+	Err    error
+}
+
+func (e *RuleError) Error() string {
+	return "agg: " + e.Stream + ": " + e.Err.Error()
+}
+
+func (e *RuleError) Unwrap() error {
+	return e.Err
+}
+
+// ruleRequest is a rule change sent by one of the synchronous
+// methods, with the outcome reported on result once applied
+type ruleRequest struct {
+	add       *Rule
+	delete    string
+	deleteAll bool
+	batch     *Batch
+	// version, if set, must match the stream's current rule
+	version *uint64
+	// applied, if set, is given the rule once it is added
+	applied *Rule
+	result  chan error
+}
+
+// AddRule sets the rule for a stream, replacing any existing rule. It
+// returns once the stream's clients have been registered to the new
+// feeds, or with an error if the rule is invalid or the hub has stopped.
+func (h *Hub) AddRule(ctx context.Context, rule Rule) error {
+	return h.requestRule(ctx, ruleRequest{add: &rule})
+}
+
+// AddRuleIf sets the rule for a stream like AddRule, but only if the
+// stream's current rule has the given version, or if version is zero
+// and the stream has no rule. Otherwise it returns ErrVersion, so that
+// a change made since the rule was read is not overwritten. It returns
+// the rule's new version.
+func (h *Hub) AddRuleIf(ctx context.Context, rule Rule, version uint64) (uint64, error) {
+
+	var applied Rule
+
+	if err := h.requestRule(ctx, ruleRequest{add: &rule, version: &version, applied: &applied}); err != nil {
+		return 0, err
+	}
+
+	return applied.Version, nil
+}
+
+// DeleteRule removes the rule for a stream. It returns once the
+// stream's clients have been unregistered from the old feeds.
+// Deleting a stream that has no rule is not an error.
+func (h *Hub) DeleteRule(ctx context.Context, stream string) error {
+	return h.requestRule(ctx, ruleRequest{delete: stream})
+}
+
+// DeleteRuleIf removes the rule for a stream like DeleteRule, but only
+// if the rule has the given version. Otherwise it returns ErrVersion.
+func (h *Hub) DeleteRuleIf(ctx context.Context, stream string, version uint64) error {
+	return h.requestRule(ctx, ruleRequest{delete: stream, version: &version})
+}
+
+// DeleteAllRules removes every rule, and returns once all stream
+// clients have been unregistered from their feeds.
+func (h *Hub) DeleteAllRules(ctx context.Context) error {
+	return h.requestRule(ctx, ruleRequest{deleteAll: true})
+}
+
+// requestRule passes a request to the run loop and waits for the result
+func (h *Hub) requestRule(ctx context.Context, req ruleRequest) error {
+
+	req.result = make(chan error, 1)
+
+	select {
+	case h.ruleRequests <- req:
+	case <-h.done:
+		return h.stopped()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-req.result:
+		return err
+	case <-h.done:
+		// the result is sent before the run loop can stop
+		select {
+		case err := <-req.result:
+			return err
+		default:
+			return h.stopped()
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handleRuleRequest is called from the run loop
+func (h *Hub) handleRuleRequest(req ruleRequest) error {
+	switch {
+	case req.deleteAll:
+		h.deleteAllRules()
+		return nil
+	case req.batch != nil:
+		return h.applyBatch(*req.batch)
+	case req.add != nil:
+		if err := h.checkVersion(req.add.Stream, req.version); err != nil {
+			return err
+		}
+		if err := h.addRule(*req.add); err != nil {
+			return err
+		}
+		if req.applied != nil {
+			*req.applied = h.rules[req.add.Stream].copy()
+		}
+		return nil
+	default:
+		if err := h.checkVersion(req.delete, req.version); err != nil {
+			return err
+		}
+		return h.deleteRule(req.delete)
+	}
+}
+
+// checkVersion returns ErrVersion if a version is given and the
+// stream's rule does not have it; a stream with no rule has version 0
+func (h *Hub) checkVersion(stream string, version *uint64) error {
+
+	if version == nil || h.rules[stream].Version == *version {
+		return nil
+	}
+
+	return &RuleError{Stream: stream, Err: ErrVersion}
+}
+
+// nextVersion returns the version for a rule being changed. It is
+// shared by all streams, so a stream's versions keep increasing even
+// if its rule is deleted and added again.
+func (h *Hub) nextVersion() uint64 {
+	h.revision++
+	return h.revision
+}
+
+// copy returns a rule that shares no memory with r
+func (r Rule) copy() Rule {
+
+	c := Rule{Stream: r.Stream, Feeds: append([]string(nil), r.Feeds...), Version: r.Version, Mux: r.Mux}
+
+	if r.Return != nil {
+		c.Return = append([]string(nil), r.Return...)
+	}
+
+	if r.Policy != nil {
+		p := *r.Policy
+		c.Policy = &p
+	}
+
+	if r.Limit != nil {
+		l := *r.Limit
+		c.Limit = &l
+	}
+
+	if r.Replay != nil {
+		replay := *r.Replay
+		c.Replay = &replay
+	}
+
+	if r.Transforms != nil {
+		c.Transforms = make(map[string][]TransformConfig)
+		for key, configs := range r.Transforms {
+			list := []TransformConfig{}
+			for _, config := range configs {
+				list = append(list, config.copy())
+			}
+			c.Transforms[key] = list
+		}
+	}
+
+	if r.Filters != nil {
+		c.Filters = make(map[string]Filter)
+		for key, f := range r.Filters {
+			f.Types = append([]int(nil), f.Types...)
+			c.Filters[key] = f
+		}
+	}
+
+	return c
+}
+
+func validateRule(rule Rule) error {
+
+	if err := validateStream(rule.Stream); err != nil {
+		return err
+	}
+
+	if len(rule.Feeds) == 0 {
+		return &RuleError{Stream: rule.Stream, Err: ErrEmptyFeeds}
+	}
+
+	if rule.Policy != nil {
+		if err := rule.Policy.validate(); err != nil {
+			return &RuleError{Stream: rule.Stream, Err: err}
+		}
+	}
+
+	if rule.Limit != nil {
+		if err := rule.Limit.validate(); err != nil {
+			return &RuleError{Stream: rule.Stream, Err: err}
+		}
+	}
+
+	if rule.Replay != nil {
+		if err := rule.Replay.validate(); err != nil {
+			return &RuleError{Stream: rule.Stream, Err: err}
+		}
+	}
+
+	for key, f := range rule.Filters {
+		if key == "" {
+			return &RuleError{Stream: rule.Stream, Err: ErrInvalidFilter}
+		}
+		if err := f.validate(); err != nil {
+			return &RuleError{Stream: rule.Stream, Err: err}
+		}
+	}
+
+	for key, configs := range rule.Transforms {
+		if key == "" {
+			return &RuleError{Stream: rule.Stream, Err: ErrInvalidTransform}
+		}
+		for _, config := range configs {
+			if err := config.validate(); err != nil {
+				return &RuleError{Stream: rule.Stream, Err: err}
+			}
+		}
+	}
+
+	for _, feed := range rule.Return {
+		if feed == "" || strings.HasPrefix(feed, streamPrefix) || isPattern(feed) {
+			return &RuleError{Stream: rule.Stream, Err: ErrInvalidReturn}
+		}
+	}
+
+	return nil
+}
+
+func validateStream(stream string) error {
+
+	if stream == DeleteAll {
+		return &RuleError{Stream: stream, Err: ErrReservedName}
+	}
+
+	if !strings.HasPrefix(stream, streamPrefix) || stream == streamPrefix {
+		return &RuleError{Stream: stream, Err: ErrInvalidPrefix}
+	}
+
+	return nil
+}
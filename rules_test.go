@@ -0,0 +1,243 @@
+package agg
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/timdrysdale/hub"
+)
+
+func TestAddRuleRejectsInvalid(t *testing.T) {
+	h := New()
+	closed := make(chan struct{})
+	defer close(closed)
+	go h.Run(closed)
+
+	ctx := context.Background()
+
+	tests := []struct {
+		rule Rule
+		want error
+	}{
+		{Rule{Stream: DeleteAll, Feeds: []string{"video0"}}, ErrReservedName},
+		{Rule{Stream: "large", Feeds: []string{"video0"}}, ErrInvalidPrefix},
+		{Rule{Stream: "stream/", Feeds: []string{"video0"}}, ErrInvalidPrefix},
+		{Rule{Stream: "stream/large"}, ErrEmptyFeeds},
+	}
+
+	for _, test := range tests {
+		err := h.AddRule(ctx, test.rule)
+		if !errors.Is(err, test.want) {
+			t.Errorf("AddRule(%v): wanted %v got %v", test.rule, test.want, err)
+		}
+		var ruleErr *RuleError
+		if !errors.As(err, &ruleErr) || ruleErr.Stream != test.rule.Stream {
+			t.Errorf("AddRule(%v): error did not report stream", test.rule)
+		}
+	}
+
+	if err := h.DeleteRule(ctx, DeleteAll); !errors.Is(err, ErrReservedName) {
+		t.Error("DeleteRule accepted reserved name", err)
+	}
+}
+
+func TestAddRuleRegistersFeeds(t *testing.T) {
+	h := New()
+	closed := make(chan struct{})
+	defer close(closed)
+	go h.Run(closed)
+
+	ctx := context.Background()
+
+	stream := "stream/large"
+	c := &hub.Client{Hub: h.Hub, Name: "aa", Topic: stream, Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	h.Register <- c
+
+	feeds := []string{"video0", "audio"}
+	if err := h.AddRule(ctx, Rule{Stream: stream, Feeds: feeds}); err != nil {
+		t.Fatal(err)
+	}
+
+	// AddRule has returned so the subclients are in place
+	for _, feed := range feeds {
+		found := false
+		for subClient := range h.SubClients[c] {
+			if subClient.Client.Topic == feed {
+				found = true
+			}
+		}
+		if !found {
+			t.Error("did not find subclient for", feed)
+		}
+	}
+
+	if err := h.DeleteRule(ctx, stream); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := h.Rules[stream]; ok {
+		t.Error("Rule still registered in Rules")
+	}
+	if len(h.SubClients[c]) != 0 {
+		t.Error("subclients not removed after deleting rule")
+	}
+
+	if err := h.DeleteAllRules(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Rules) != 0 {
+		t.Error("Rules not empty after deleting all rules")
+	}
+}
+
+func TestRuleRequestsAfterClose(t *testing.T) {
+	h := New()
+	closed := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		h.Run(closed)
+		close(stopped)
+	}()
+	close(closed)
+	<-stopped
+
+	err := h.AddRule(context.Background(), Rule{Stream: "stream/large", Feeds: []string{"video0"}})
+	if err != ErrHubClosed {
+		t.Error("wanted ErrHubClosed, got", err)
+	}
+}
+
+func TestRuleRequestsHonourContext(t *testing.T) {
+	h := New() // not running, so requests cannot be serviced
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+
+	if err := h.DeleteRule(ctx, "stream/large"); err != context.DeadlineExceeded {
+		t.Error("wanted context.DeadlineExceeded, got", err)
+	}
+}
+
+func TestRuleVersions(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	stream := "stream/large"
+
+	// version 0 means there must be no rule yet
+	v1, err := h.AddRuleIf(ctx, Rule{Stream: stream, Feeds: []string{"video0"}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.AddRuleIf(ctx, Rule{Stream: stream, Feeds: []string{"video1"}}, 0); !errors.Is(err, ErrVersion) {
+		t.Error("wanted ErrVersion creating existing rule, got", err)
+	}
+
+	v2, err := h.AddRuleIf(ctx, Rule{Stream: stream, Feeds: []string{"video1"}}, v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v2 <= v1 {
+		t.Error("version did not increase", v1, v2)
+	}
+
+	// someone else's change is not overwritten
+	if _, err := h.AddRuleIf(ctx, Rule{Stream: stream, Feeds: []string{"audio"}}, v1); !errors.Is(err, ErrVersion) {
+		t.Error("wanted ErrVersion, got", err)
+	}
+	if err := h.DeleteRuleIf(ctx, stream, v1); !errors.Is(err, ErrVersion) {
+		t.Error("wanted ErrVersion deleting, got", err)
+	}
+
+	s, err := h.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule := s.Rules[stream]; rule.Version != v2 || rule.Feeds[0] != "video1" {
+		t.Error("wrong rule after conflicts", rule)
+	}
+
+	if err := h.DeleteRuleIf(ctx, stream, v2); err != nil {
+		t.Fatal(err)
+	}
+
+	// versions keep increasing after the rule is deleted
+	v3, err := h.AddRuleIf(ctx, Rule{Stream: stream, Feeds: []string{"video0"}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v3 <= v2 {
+		t.Error("version reused after delete", v2, v3)
+	}
+}
+
+func TestReplaceRuleKeepsUnchangedFeeds(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	stream := "stream/large"
+	if err := h.AddRule(ctx, Rule{Stream: stream, Feeds: []string{"video0", "audio"}}); err != nil {
+		t.Fatal(err)
+	}
+	c := &hub.Client{Hub: h.Hub, Name: "aa", Topic: stream, Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	if err := h.RegisterWithOptions(ctx, c, ClientOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := h.Subscribe(ctx, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := func() Event {
+		t.Helper()
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(time.Second):
+			t.Fatal("no event")
+		}
+		return Event{}
+	}
+
+	// only the audio changes, so the video relay is left alone
+	if err := h.AddRule(ctx, Rule{Stream: stream, Feeds: []string{"video0", "audio1"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []Event{
+		{Type: RuleReplaced},
+		{Type: FeedAttached, Feed: "audio1"},
+		{Type: FeedDetached, Feed: "audio"},
+	} {
+		if e := next(); e.Type != want.Type || e.Feed != want.Feed {
+			t.Error("wanted", want.Type, want.Feed, "got", e.Type, e.Feed)
+		}
+	}
+
+	// a new policy restarts every relay
+	policy := &RelayPolicy{Mode: RelayDropOldest, Size: 4}
+	if err := h.AddRule(ctx, Rule{Stream: stream, Feeds: []string{"video0", "audio1"}, Policy: policy}); err != nil {
+		t.Fatal(err)
+	}
+	if e := next(); e.Type != RuleReplaced {
+		t.Error("wanted", RuleReplaced, "got", e.Type)
+	}
+	detached, attached := 0, 0
+	for i := 0; i < 4; i++ {
+		switch next().Type {
+		case FeedDetached:
+			detached++
+		case FeedAttached:
+			attached++
+		}
+	}
+	if detached != 2 || attached != 2 {
+		t.Error("wanted both relays restarted, got", detached, "detached and", attached, "attached")
+	}
+}
@@ -0,0 +1,416 @@
+package agg
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// ScheduleSkipped reports a schedule whose rule could not be applied
+const ScheduleSkipped EventType = "scheduleSkipped"
+
+var ErrInvalidSchedule = errors.New("schedule needs a name, and windows that end after they start")
+
+// Schedule is a rule that applies during its windows, timed with
+// Hub.Clock, and is not saved in Store. If schedules for the same
+// stream overlap, the first by name takes precedence.
+type Schedule struct {
+	Name    string        `json:"name"`
+	Rule    Rule          `json:"rule"`
+	Windows []Window      `json:"windows,omitempty"`
+	Daily   []DailyWindow `json:"daily,omitempty"`
+}
+
+// Window is a single period, e.g. a booking slot
+type Window struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// DailyWindow repeats at the same times each day, in the location of
+// the hub's clock. Start and End are given as "15:04"; if End is not
+// after Start, the window runs past midnight. If Days is set, the
+// window only starts on those days.
+type DailyWindow struct {
+	Start string         `json:"start"`
+	End   string         `json:"end"`
+	Days  []time.Weekday `json:"days,omitempty"`
+}
+
+// override records the rule a schedule replaced
+type override struct {
+	name    string
+	applied Rule
+	// base is nil if the stream had no rule
+	base *Rule
+}
+
+type scheduleRequest struct {
+	add    *Schedule
+	delete string
+	result chan error
+}
+
+// AddSchedule adds a schedule, replacing any with the same name. It
+// returns once the rule has been applied, if a window is open. If the
+// rule cannot be applied, the schedule is not added, and the error
+// is returned.
+func (h *Hub) AddSchedule(ctx context.Context, schedule Schedule) error {
+
+	if err := schedule.validate(); err != nil {
+		return err
+	}
+
+	return h.requestSchedule(ctx, scheduleRequest{add: &schedule})
+}
+
+// DeleteSchedule removes a schedule, and puts back the rule it
+// replaced if a window is open. Deleting a schedule that does not
+// exist is not an error.
+func (h *Hub) DeleteSchedule(ctx context.Context, name string) error {
+	return h.requestSchedule(ctx, scheduleRequest{delete: name})
+}
+
+func (h *Hub) requestSchedule(ctx context.Context, req scheduleRequest) error {
+
+	req.result = make(chan error, 1)
+
+	select {
+	case h.scheduleRequests <- req:
+	case <-h.done:
+		return h.stopped()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-req.result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handleSchedule is called from the run loop
+func (h *Hub) handleSchedule(req scheduleRequest) {
+
+	name := req.delete
+	if req.add != nil {
+		name = req.add.Name
+	}
+
+	// a replaced schedule starts afresh with its new rule
+	for stream, o := range h.overrides {
+		if o.name == name {
+			h.revert(stream)
+		}
+	}
+
+	old, replaced := h.schedules[name]
+
+	if req.add != nil {
+		h.schedules[name] = req.add.copy()
+	} else {
+		delete(h.schedules, name)
+	}
+
+	skipped := h.applySchedules()
+
+	if err, ok := skipped[name]; ok && req.add != nil {
+		// put back the schedule this one was to replace
+		delete(h.schedules, name)
+		delete(skipped, name)
+		if replaced {
+			h.schedules[name] = old
+		}
+		for other, err := range h.applySchedules() {
+			skipped[other] = err
+		}
+		h.emitSkipped(skipped)
+		req.result <- err
+		return
+	}
+
+	h.emitSkipped(skipped)
+
+	req.result <- nil
+}
+
+// applySchedules brings the rules into line with the open windows,
+// and sets a timer for the next window to open or close. It returns
+// the error for each schedule whose rule could not be applied, by
+// name. It is called from the run loop.
+func (h *Hub) applySchedules() map[string]error {
+
+	now := h.clock().Now()
+
+	names := []string{}
+	for name := range h.schedules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	active := make(map[string]Schedule)
+	for _, name := range names {
+		s := h.schedules[name]
+		if _, ok := active[s.Rule.Stream]; !ok && s.active(now) {
+			active[s.Rule.Stream] = s
+		}
+	}
+
+	for stream, o := range h.overrides {
+		if s, ok := active[stream]; !ok || s.Name != o.name {
+			h.revert(stream)
+		}
+	}
+
+	skipped := make(map[string]error)
+
+	for stream, s := range active {
+		if _, ok := h.overrides[stream]; !ok {
+			if err := h.apply(s); err != nil {
+				skipped[s.Name] = err
+			}
+		}
+	}
+
+	if h.scheduleTimer != nil {
+		h.scheduleTimer.Stop()
+		h.scheduleTimer = nil
+	}
+
+	var next time.Time
+	for _, s := range h.schedules {
+		if t, ok := s.next(now); ok && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+
+	if !next.IsZero() {
+		h.scheduleTimer = h.clock().AfterFunc(next.Sub(now), func() {
+			select {
+			case h.scheduleTicks <- struct{}{}:
+			case <-h.done:
+			}
+		})
+	}
+
+	return skipped
+}
+
+// emitSkipped reports the schedules whose rules could not be applied
+func (h *Hub) emitSkipped(skipped map[string]error) {
+
+	for name, err := range skipped {
+		s := h.schedules[name]
+		h.emit(Event{Type: ScheduleSkipped, Stream: s.Rule.Stream, Schedule: name, Error: err.Error()})
+	}
+}
+
+// apply replaces the stream's rule with the schedule's
+func (h *Hub) apply(s Schedule) error {
+
+	o := &override{name: s.Name}
+
+	if rule, ok := h.rules[s.Rule.Stream]; ok {
+		base := rule.copy()
+		o.base = &base
+	}
+
+	// the rule was valid when the schedule was added, but could
+	// make a cycle with rules added since, in which case it is skipped
+	if err := h.addRule(s.Rule.copy()); err != nil {
+		return err
+	}
+
+	// the applied rule has its own version, so any change
+	// made while the schedule is in effect can be told apart
+	o.applied = h.rules[s.Rule.Stream].copy()
+
+	h.overrides[s.Rule.Stream] = o
+
+	return nil
+}
+
+// revert puts back the rule a schedule replaced, unless the rule has
+// been changed since
+func (h *Hub) revert(stream string) {
+
+	o := h.overrides[stream]
+	delete(h.overrides, stream)
+
+	if rule, ok := h.rules[stream]; !ok || !reflect.DeepEqual(rule, o.applied) {
+		return
+	}
+
+	if o.base == nil {
+		h.deleteRule(stream)
+		return
+	}
+
+	if err := h.addRule(o.base.copy()); err != nil {
+		// the old rule now makes a cycle, so the stream gets no rule
+		h.deleteRule(stream)
+	}
+}
+
+// baseRule returns the rule for a stream as it is outside any
+// schedule, for saving in the store
+func (h *Hub) baseRule(stream string) (Rule, bool) {
+
+	rule, ok := h.rules[stream]
+
+	if o, scheduled := h.overrides[stream]; scheduled && ok && reflect.DeepEqual(rule, o.applied) {
+		if o.base == nil {
+			return Rule{}, false
+		}
+		return o.base.copy(), true
+	}
+
+	return rule, ok
+}
+
+// stopSchedules stops the schedule timer, when the hub stops
+func (h *Hub) stopSchedules() {
+
+	if h.scheduleTimer != nil {
+		h.scheduleTimer.Stop()
+	}
+}
+
+// active reports whether any of the schedule's windows are open
+func (s Schedule) active(now time.Time) bool {
+
+	for _, w := range s.windows(now) {
+		if !now.Before(w.Start) && now.Before(w.End) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// next returns the next time after now that a window opens or closes
+func (s Schedule) next(now time.Time) (time.Time, bool) {
+
+	var next time.Time
+
+	for _, w := range s.windows(now) {
+		for _, t := range []time.Time{w.Start, w.End} {
+			if t.After(now) && (next.IsZero() || t.Before(next)) {
+				next = t
+			}
+		}
+	}
+
+	return next, !next.IsZero()
+}
+
+// windows returns the fixed windows, and the daily windows from the
+// day before now until a week after
+func (s Schedule) windows(now time.Time) []Window {
+
+	windows := append([]Window(nil), s.Windows...)
+
+	y, m, d := now.Date()
+
+	for _, dw := range s.Daily {
+
+		sh, sm, _ := parseTimeOfDay(dw.Start)
+		eh, em, _ := parseTimeOfDay(dw.End)
+
+		for i := -1; i <= 7; i++ {
+
+			start := time.Date(y, m, d+i, sh, sm, 0, 0, now.Location())
+			if !dw.on(start.Weekday()) {
+				continue
+			}
+
+			end := time.Date(y, m, d+i, eh, em, 0, 0, now.Location())
+			if !end.After(start) {
+				end = time.Date(y, m, d+i+1, eh, em, 0, 0, now.Location())
+			}
+
+			windows = append(windows, Window{Start: start, End: end})
+		}
+	}
+
+	return windows
+}
+
+func (dw DailyWindow) on(day time.Weekday) bool {
+
+	if len(dw.Days) == 0 {
+		return true
+	}
+
+	for _, d := range dw.Days {
+		if d == day {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseTimeOfDay(s string) (int, int, error) {
+
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return t.Hour(), t.Minute(), nil
+}
+
+func (s Schedule) validate() error {
+
+	if err := validateRule(s.Rule); err != nil {
+		return err
+	}
+
+	invalid := &RuleError{Stream: s.Rule.Stream, Err: ErrInvalidSchedule}
+
+	if s.Name == "" || len(s.Windows)+len(s.Daily) == 0 {
+		return invalid
+	}
+
+	for _, w := range s.Windows {
+		if !w.End.After(w.Start) {
+			return invalid
+		}
+	}
+
+	for _, dw := range s.Daily {
+		if _, _, err := parseTimeOfDay(dw.Start); err != nil {
+			return invalid
+		}
+		if _, _, err := parseTimeOfDay(dw.End); err != nil {
+			return invalid
+		}
+		if dw.Start == dw.End {
+			return invalid
+		}
+	}
+
+	return nil
+}
+
+// copy returns a schedule that shares no memory with s
+func (s Schedule) copy() Schedule {
+
+	c := Schedule{
+		Name:    s.Name,
+		Rule:    s.Rule.copy(),
+		Windows: append([]Window(nil), s.Windows...),
+	}
+
+	for _, dw := range s.Daily {
+		dw.Days = append([]time.Weekday(nil), dw.Days...)
+		c.Daily = append(c.Daily, dw)
+	}
+
+	return c
+}
@@ -0,0 +1,263 @@
+package agg
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/timdrysdale/hub"
+)
+
+// testClock only moves when advanced, running any timers that fall due
+type testClock struct {
+	sync.Mutex
+	now    time.Time
+	timers []*testTimer
+}
+
+type testTimer struct {
+	at      time.Time
+	f       func()
+	stopped bool
+}
+
+func (c *testClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *testClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.Lock()
+	defer c.Unlock()
+	t := &testTimer{at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (t *testTimer) Stop() bool {
+	stopped := t.stopped
+	t.stopped = true
+	return !stopped
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.Lock()
+	c.now = c.now.Add(d)
+	due := []*testTimer{}
+	for _, t := range c.timers {
+		if !t.stopped && !t.at.After(c.now) {
+			t.stopped = true
+			due = append(due, t)
+		}
+	}
+	c.Unlock()
+
+	for _, t := range due {
+		t.f()
+	}
+}
+
+func TestScheduleDaily(t *testing.T) {
+
+	clock := &testClock{now: time.Date(2020, 6, 1, 8, 0, 0, 0, time.UTC)}
+
+	h := New()
+	h.Clock = clock
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	stream := "stream/large"
+	if err := h.AddRule(ctx, Rule{Stream: stream, Feeds: []string{"video0"}}); err != nil {
+		t.Fatal(err)
+	}
+	c := &hub.Client{Hub: h.Hub, Name: "aa", Topic: stream, Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	if err := h.RegisterWithOptions(ctx, c, ClientOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	schedule := Schedule{
+		Name:  "office hours",
+		Rule:  Rule{Stream: stream, Feeds: []string{"video0", "audio"}},
+		Daily: []DailyWindow{{Start: "09:00", End: "17:00"}},
+	}
+	if err := h.AddSchedule(ctx, schedule); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(when string, feeds []string, scheduled string) {
+		t.Helper()
+		s, err := h.Snapshot(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.Streams[stream][0].Feeds; !reflect.DeepEqual(got, feeds) {
+			t.Error(when, "wrong feeds", got)
+		}
+		if s.Scheduled[stream] != scheduled {
+			t.Error(when, "wrong schedule in snapshot", s.Scheduled)
+		}
+	}
+
+	check("before window", []string{"video0"}, "")
+
+	clock.Advance(time.Hour)
+	check("in window", []string{"audio", "video0"}, "office hours")
+
+	clock.Advance(8 * time.Hour)
+	check("after window", []string{"video0"}, "")
+
+	// next morning
+	clock.Advance(16 * time.Hour)
+	check("next day", []string{"audio", "video0"}, "office hours")
+
+	if err := h.DeleteSchedule(ctx, "office hours"); err != nil {
+		t.Fatal(err)
+	}
+	check("after delete", []string{"video0"}, "")
+}
+
+func TestScheduleWindow(t *testing.T) {
+
+	clock := &testClock{now: time.Date(2020, 6, 1, 8, 0, 0, 0, time.UTC)}
+
+	h := New()
+	h.Clock = clock
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	stream := "stream/booking"
+	start := clock.now.Add(time.Hour)
+	schedule := Schedule{
+		Name:    "booking",
+		Rule:    Rule{Stream: stream, Feeds: []string{"video0"}},
+		Windows: []Window{{Start: start, End: start.Add(time.Hour)}},
+	}
+	if err := h.AddSchedule(ctx, schedule); err != nil {
+		t.Fatal(err)
+	}
+
+	rule := func() (Rule, bool) {
+		s, err := h.Snapshot(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, ok := s.Rules[stream]
+		return r, ok
+	}
+
+	if _, ok := rule(); ok {
+		t.Error("rule before window")
+	}
+
+	clock.Advance(time.Hour)
+	if r, ok := rule(); !ok || !reflect.DeepEqual(r.Feeds, []string{"video0"}) {
+		t.Error("wrong rule in window", r)
+	}
+
+	// a change made during the window is kept when it ends
+	if err := h.AddRule(ctx, Rule{Stream: stream, Feeds: []string{"video1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Hour)
+	if r, ok := rule(); !ok || !reflect.DeepEqual(r.Feeds, []string{"video1"}) {
+		t.Error("wrong rule after window", r)
+	}
+}
+
+func TestScheduleSkipped(t *testing.T) {
+
+	clock := &testClock{now: time.Date(2020, 6, 1, 8, 0, 0, 0, time.UTC)}
+
+	h := New()
+	h.Clock = clock
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	events, err := h.Subscribe(ctx, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the schedule's rule is valid when added, but makes a cycle
+	// with a rule added before its window opens
+	start := clock.now.Add(time.Hour)
+	later := Schedule{
+		Name:    "later",
+		Rule:    Rule{Stream: "stream/b", Feeds: []string{"stream/a"}},
+		Windows: []Window{{Start: start, End: start.Add(time.Hour)}},
+	}
+	if err := h.AddSchedule(ctx, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AddRule(ctx, Rule{Stream: "stream/a", Feeds: []string{"stream/b"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Hour)
+
+	deadline := time.After(time.Second)
+	for skipped := false; !skipped; {
+		select {
+		case e := <-events:
+			skipped = e.Type == ScheduleSkipped
+			if skipped && (e.Schedule != "later" || e.Stream != "stream/b" || e.Error == "") {
+				t.Error("wrong event", e)
+			}
+		case <-deadline:
+			t.Fatal("no scheduleSkipped event")
+		}
+	}
+
+	if err := h.DeleteSchedule(ctx, "later"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a schedule whose window is open is applied straight away, so
+	// one that cannot be is refused
+	now := Schedule{
+		Name:    "now",
+		Rule:    Rule{Stream: "stream/b", Feeds: []string{"stream/a"}},
+		Windows: []Window{{Start: clock.now, End: clock.now.Add(time.Hour)}},
+	}
+	if err := h.AddSchedule(ctx, now); !errors.Is(err, ErrCycle) {
+		t.Error("wanted ErrCycle, got", err)
+	}
+
+	s, err := h.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Schedules["now"]; ok {
+		t.Error("refused schedule was added")
+	}
+	if _, ok := s.Rules["stream/b"]; ok || len(s.Scheduled) != 0 {
+		t.Error("refused schedule was applied", s.Scheduled)
+	}
+}
+
+func TestInvalidSchedule(t *testing.T) {
+
+	now := time.Now()
+	rule := Rule{Stream: "stream/large", Feeds: []string{"video0"}}
+
+	tests := []Schedule{
+		{Rule: rule, Daily: []DailyWindow{{Start: "09:00", End: "17:00"}}},
+		{Name: "none", Rule: rule},
+		{Name: "backwards", Rule: rule, Windows: []Window{{Start: now, End: now.Add(-time.Hour)}}},
+		{Name: "time", Rule: rule, Daily: []DailyWindow{{Start: "9am", End: "17:00"}}},
+	}
+
+	for _, test := range tests {
+		if err := test.validate(); err == nil {
+			t.Error("invalid schedule accepted", test.Name)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package agg
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+)
+
+// Snapshot is a copy of the hub's routing state, taken by the run
+// loop. It shares no memory with the hub, so it can be read from any
+// goroutine while the hub carries on changing.
+type Snapshot struct {
+	// Rules maps each stream to its rule
+	Rules map[string]Rule `json:"rules"`
+	// Streams maps each stream to its registered clients, sorted by name
+	Streams map[string][]StreamClient `json:"streams"`
+	// Mutes maps each stream with muted feeds to its mutes, sorted by feed
+	Mutes map[string][]Mute `json:"mutes"`
+	// Schedules maps each schedule's name to the schedule
+	Schedules map[string]Schedule `json:"schedules"`
+	// Scheduled maps each stream whose rule is set by a schedule to
+	// the schedule's name
+	Scheduled map[string]string `json:"scheduled"`
+	// SubClients counts the subclients relaying feeds to stream
+	// clients; a feed in several of a client's streams has one
+	SubClients int `json:"subClients"`
+}
+
+// StreamClient describes a client registered to a stream
+type StreamClient struct {
+	Name string `json:"name"`
+	// Feeds are the topics currently relayed to the client, sorted
+	Feeds []string `json:"feeds"`
+	// Dropped counts messages discarded by the client's relay policy
+	Dropped uint64 `json:"dropped"`
+}
+
+type snapshotRequest struct {
+	result chan Snapshot
+}
+
+// Snapshot returns a copy of the rules, streams and feed relays as
+// they stand once the run loop has finished any change in progress.
+func (h *Hub) Snapshot(ctx context.Context) (Snapshot, error) {
+
+	req := snapshotRequest{result: make(chan Snapshot, 1)}
+
+	select {
+	case h.snapshotRequests <- req:
+	case <-h.done:
+		return Snapshot{}, h.stopped()
+	case <-ctx.Done():
+		return Snapshot{}, ctx.Err()
+	}
+
+	select {
+	case s := <-req.result:
+		return s, nil
+	case <-ctx.Done():
+		return Snapshot{}, ctx.Err()
+	}
+}
+
+// snapshot is called from the run loop
+func (h *Hub) snapshot() Snapshot {
+
+	s := Snapshot{
+		Rules:     make(map[string]Rule),
+		Streams:   make(map[string][]StreamClient),
+		Mutes:     make(map[string][]Mute),
+		Schedules: make(map[string]Schedule),
+		Scheduled: make(map[string]string),
+	}
+
+	for stream, rule := range h.rules {
+		s.Rules[stream] = rule.copy()
+	}
+
+	for stream, clients := range h.Streams {
+		// a client in several streams is only listed with
+		// the feeds that come from this one
+		topics := make(map[string]bool)
+		if rule, ok := h.rules[stream]; ok {
+			for _, topic := range h.resolve(rule) {
+				topics[topic] = true
+			}
+		}
+		list := []StreamClient{}
+		for client := range clients {
+			sc := StreamClient{Name: client.Name, Feeds: []string{}}
+			for subClient := range h.SubClients[client] {
+				if topics[subClient.Client.Topic] {
+					sc.Feeds = append(sc.Feeds, subClient.Client.Topic)
+				}
+			}
+			sort.Strings(sc.Feeds)
+			if counters, ok := h.counters[client]; ok {
+				sc.Dropped = atomic.LoadUint64(&counters.dropped)
+			}
+			list = append(list, sc)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+		s.Streams[stream] = list
+	}
+
+	for _, subClients := range h.SubClients {
+		s.SubClients += len(subClients)
+	}
+
+	for stream := range h.mutes {
+		s.Mutes[stream] = h.muteList(stream)
+	}
+
+	for name, schedule := range h.schedules {
+		s.Schedules[name] = schedule.copy()
+	}
+
+	for stream, o := range h.overrides {
+		s.Scheduled[stream] = o.name
+	}
+
+	return s
+}
@@ -0,0 +1,68 @@
+package agg
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/timdrysdale/hub"
+)
+
+func TestSnapshot(t *testing.T) {
+	h := New()
+	closed := make(chan struct{})
+	defer close(closed)
+	go h.Run(closed)
+
+	ctx := context.Background()
+
+	stream := "stream/large"
+	feeds := []string{"video0", "audio"}
+
+	if err := h.AddRule(ctx, Rule{Stream: stream, Feeds: feeds}); err != nil {
+		t.Fatal(err)
+	}
+
+	c0 := &hub.Client{Hub: h.Hub, Name: "b", Topic: stream, Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	c1 := &hub.Client{Hub: h.Hub, Name: "a", Topic: stream, Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	h.Register <- c0
+	h.Register <- c1
+
+	s, err := h.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(s.Rules[stream].Feeds, feeds) {
+		t.Error("wrong feeds in snapshot rule", s.Rules[stream].Feeds)
+	}
+
+	want := []StreamClient{
+		{Name: "a", Feeds: []string{"audio", "video0"}},
+		{Name: "b", Feeds: []string{"audio", "video0"}},
+	}
+	if !reflect.DeepEqual(s.Streams[stream], want) {
+		t.Error("wrong clients in snapshot stream", s.Streams[stream])
+	}
+
+	// the snapshot must not change with the hub
+	s.Rules[stream].Feeds[0] = "changed"
+	if err := h.DeleteRule(ctx, stream); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Rules[stream].Feeds[1] != "audio" || len(s.Streams[stream][0].Feeds) != 2 {
+		t.Error("snapshot changed after rule deleted")
+	}
+
+	s, err = h.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Rules[stream]; ok {
+		t.Error("deleted rule in snapshot")
+	}
+	if len(s.Streams[stream]) != 2 || len(s.Streams[stream][0].Feeds) != 0 {
+		t.Error("wrong clients in snapshot after rule deleted", s.Streams[stream])
+	}
+}
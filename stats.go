@@ -0,0 +1,240 @@
+package agg
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/timdrysdale/hub"
+)
+
+// relayCounters are updated atomically by relays. Each relay adds to
+// the counters of its stream client, and of its feed within the stream.
+type relayCounters struct {
+	messages     uint64
+	bytes        uint64
+	dropped      uint64
+	errors       uint64
+	latencyCount uint64
+	latencyTotal uint64 // nanoseconds
+	latencyMax   uint64 // nanoseconds
+
+	// since is set before the counters are shared
+	since time.Time
+}
+
+// StreamStats are the statistics for one stream. Feed counts
+// accumulate for as long as the stream has a rule or clients;
+// destination counts last as long as the client is registered.
+type StreamStats struct {
+	Stream       string                `json:"stream"`
+	Subscribers  int                   `json:"subscribers"`
+	Feeds        map[string]RelayStats `json:"feeds"`
+	Destinations []DestinationStats    `json:"destinations"`
+}
+
+// RelayStats count the messages relayed into a stream. Latency is
+// measured from hub.Message.Sent to delivery on the stream client.
+type RelayStats struct {
+	Messages    uint64        `json:"messages"`
+	Bytes       uint64        `json:"bytes"`
+	Dropped     uint64        `json:"dropped"`
+	Errors      uint64        `json:"errors"`
+	MeanLatency time.Duration `json:"meanLatency"`
+	MaxLatency  time.Duration `json:"maxLatency"`
+}
+
+// DestinationStats count the messages delivered to one stream client
+// since it registered, with its average throughput over that time
+type DestinationStats struct {
+	Name string `json:"name"`
+	RelayStats
+	Since             time.Time `json:"since"`
+	MessagesPerSecond float64   `json:"messagesPerSecond"`
+	BytesPerSecond    float64   `json:"bytesPerSecond"`
+}
+
+type statsRequest struct {
+	result chan map[string]StreamStats
+}
+
+// StreamStats returns the statistics for every stream that has a rule
+// or clients, keyed by stream
+func (h *Hub) StreamStats(ctx context.Context) (map[string]StreamStats, error) {
+
+	req := statsRequest{result: make(chan map[string]StreamStats, 1)}
+
+	select {
+	case h.statsRequests <- req:
+	case <-h.done:
+		return nil, h.stopped()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	select {
+	case s := <-req.result:
+		return s, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// stats is called from the run loop
+func (h *Hub) stats() map[string]StreamStats {
+
+	now := time.Now()
+	all := make(map[string]StreamStats)
+
+	get := func(stream string) StreamStats {
+		s, ok := all[stream]
+		if !ok {
+			s = StreamStats{
+				Stream:       stream,
+				Feeds:        make(map[string]RelayStats),
+				Destinations: []DestinationStats{},
+			}
+		}
+		return s
+	}
+
+	for stream := range h.rules {
+		all[stream] = get(stream)
+	}
+
+	for stream, feeds := range h.feedCounters {
+		s := get(stream)
+		for feed, counters := range feeds {
+			s.Feeds[feed] = counters.load()
+		}
+		all[stream] = s
+	}
+
+	for stream, clients := range h.Streams {
+		if len(clients) == 0 {
+			continue
+		}
+		s := get(stream)
+		s.Subscribers = len(clients)
+		for client := range clients {
+			counters, ok := h.counters[client]
+			if !ok {
+				continue
+			}
+			d := DestinationStats{
+				Name:       client.Name,
+				RelayStats: counters.load(),
+				Since:      counters.since,
+			}
+			if elapsed := now.Sub(counters.since).Seconds(); elapsed > 0 {
+				d.MessagesPerSecond = float64(d.Messages) / elapsed
+				d.BytesPerSecond = float64(d.Bytes) / elapsed
+			}
+			s.Destinations = append(s.Destinations, d)
+		}
+		sort.Slice(s.Destinations, func(i, j int) bool { return s.Destinations[i].Name < s.Destinations[j].Name })
+		all[stream] = s
+	}
+
+	return all
+}
+
+// countersFor returns the counters for a feed of a stream
+func (h *Hub) countersFor(stream, feed string) *relayCounters {
+
+	if _, ok := h.feedCounters[stream]; !ok {
+		h.feedCounters[stream] = make(map[string]*relayCounters)
+	}
+
+	if _, ok := h.feedCounters[stream][feed]; !ok {
+		h.feedCounters[stream][feed] = &relayCounters{since: time.Now()}
+	}
+
+	return h.feedCounters[stream][feed]
+}
+
+// pruneStats forgets the feed counters of a stream that
+// no longer has a rule or any clients
+func (h *Hub) pruneStats(stream string) {
+
+	if _, ok := h.rules[stream]; ok {
+		return
+	}
+
+	if len(h.Streams[stream]) > 0 {
+		return
+	}
+
+	delete(h.feedCounters, stream)
+}
+
+func (c *relayCounters) load() RelayStats {
+
+	s := RelayStats{
+		Messages:   atomic.LoadUint64(&c.messages),
+		Bytes:      atomic.LoadUint64(&c.bytes),
+		Dropped:    atomic.LoadUint64(&c.dropped),
+		Errors:     atomic.LoadUint64(&c.errors),
+		MaxLatency: time.Duration(atomic.LoadUint64(&c.latencyMax)),
+	}
+
+	if n := atomic.LoadUint64(&c.latencyCount); n > 0 {
+		s.MeanLatency = time.Duration(atomic.LoadUint64(&c.latencyTotal) / n)
+	}
+
+	return s
+}
+
+func (c *relayCounters) add(bytes int, latency time.Duration, timed bool) {
+
+	atomic.AddUint64(&c.messages, 1)
+	atomic.AddUint64(&c.bytes, uint64(bytes))
+
+	if !timed {
+		return
+	}
+
+	if latency < 0 {
+		latency = 0
+	}
+
+	ns := uint64(latency)
+	atomic.AddUint64(&c.latencyCount, 1)
+	atomic.AddUint64(&c.latencyTotal, ns)
+
+	for {
+		max := atomic.LoadUint64(&c.latencyMax)
+		if ns <= max || atomic.CompareAndSwapUint64(&c.latencyMax, max, ns) {
+			return
+		}
+	}
+}
+
+// delivered records a message taken by the stream client
+func (sc *SubClient) delivered(msg hub.Message) {
+
+	timed := !msg.Sent.IsZero()
+	latency := time.Since(msg.Sent)
+
+	for _, c := range []*relayCounters{sc.counters, sc.feedCounters} {
+		if c != nil {
+			c.add(len(msg.Data), latency, timed)
+		}
+	}
+}
+
+// drop records a message discarded by the relay policy
+func (sc *SubClient) drop() {
+	sc.dropped(1)
+}
+
+// dropped records n messages that were not relayed
+func (sc *SubClient) dropped(n uint64) {
+
+	for _, c := range []*relayCounters{sc.counters, sc.feedCounters} {
+		if c != nil {
+			atomic.AddUint64(&c.dropped, n)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package agg
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/timdrysdale/hub"
+)
+
+func TestStreamStats(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	stream := "stream/large"
+	if err := h.AddRule(ctx, Rule{Stream: stream, Feeds: []string{"video0", "audio"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &hub.Client{Hub: h.Hub, Name: "aa", Topic: stream, Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	h.Register <- c
+
+	video := &hub.Client{Hub: h.Hub, Name: "video", Topic: "video0", Send: make(chan hub.Message)}
+	h.Register <- video
+
+	time.Sleep(time.Millisecond)
+
+	sent := time.Now().Add(-10 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		h.Broadcast <- hub.Message{Data: []byte("test"), Sender: *video, Sent: sent}
+		<-c.Send
+	}
+
+	// the relay counts a message just after delivering it
+	var s StreamStats
+	deadline := time.Now().Add(time.Second)
+	for {
+		all, err := h.StreamStats(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s = all[stream]
+		if s.Feeds["video0"].Messages == 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if s.Subscribers != 1 {
+		t.Error("wanted 1 subscriber, got", s.Subscribers)
+	}
+
+	v := s.Feeds["video0"]
+	if v.Messages != 2 || v.Bytes != 8 {
+		t.Error("wrong video0 counts", v)
+	}
+	if v.MeanLatency < 10*time.Millisecond || v.MaxLatency < v.MeanLatency {
+		t.Error("wrong video0 latency", v.MeanLatency, v.MaxLatency)
+	}
+	if a := s.Feeds["audio"]; a.Messages != 0 {
+		t.Error("wrong audio counts", a)
+	}
+
+	if len(s.Destinations) != 1 {
+		t.Fatal("wanted 1 destination, got", s.Destinations)
+	}
+	d := s.Destinations[0]
+	if d.Name != "aa" || d.Messages != 2 || d.Bytes != 8 || d.BytesPerSecond <= 0 {
+		t.Error("wrong destination stats", d)
+	}
+
+	// feed counts outlive the client, but not the rule
+	h.Unregister <- c
+	all, err := h.StreamStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all[stream].Subscribers != 0 || all[stream].Feeds["video0"].Messages != 2 {
+		t.Error("wrong stats after client left", all[stream])
+	}
+
+	if err := h.DeleteRule(ctx, stream); err != nil {
+		t.Fatal(err)
+	}
+	all, err = h.StreamStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := all[stream]; ok {
+		t.Error("stats kept for stream with no rule or clients")
+	}
+}
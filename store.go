@@ -0,0 +1,166 @@
+package agg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// RuleStore keeps rules across restarts. If Hub.Store is set, the
+// hub loads the rules when it starts, and saves them all after each
+// change, with the highest version it has given to a rule, so that
+// versions are not reused after a rule is deleted. Save is called
+// from the run loop, so should not be slow.
+type RuleStore interface {
+	Load() (rules []Rule, revision uint64, err error)
+	Save(rules []Rule, revision uint64) error
+}
+
+// FileStore is a RuleStore that keeps the rules in a JSON file
+type FileStore struct {
+	Path string
+}
+
+func NewFileStore(path string) *FileStore {
+	return &FileStore{Path: path}
+}
+
+// storedRules is the contents of a FileStore
+type storedRules struct {
+	Revision uint64 `json:"revision"`
+	Rules    []Rule `json:"rules"`
+}
+
+// Load reads the rules from the file; a missing file holds no rules.
+// A file holding just a list of rules, with no revision, is accepted.
+func (s *FileStore) Load() ([]Rule, uint64, error) {
+
+	data, err := os.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var rules []Rule
+		if err := json.Unmarshal(data, &rules); err != nil {
+			return nil, 0, err
+		}
+		return rules, 0, nil
+	}
+
+	var stored storedRules
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, 0, err
+	}
+
+	return stored.Rules, stored.Revision, nil
+}
+
+// Save writes the rules to a temporary file next to the store, then
+// renames it over the store, so a crash cannot leave it half written
+func (s *FileStore) Save(rules []Rule, revision uint64) error {
+
+	data, err := json.MarshalIndent(storedRules{Revision: revision, Rules: rules}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp*")
+	if err != nil {
+		return err
+	}
+
+	// tidy up if we don't get as far as the rename
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), s.Path)
+}
+
+// loadRules applies the stored rules, when the hub starts
+func (h *Hub) loadRules() error {
+
+	if h.Store == nil {
+		return nil
+	}
+
+	rules, revision, err := h.Store.Load()
+	if err != nil {
+		return fmt.Errorf("agg: loading rules: %w", err)
+	}
+
+	for _, rule := range rules {
+		version := rule.Version
+		if err := h.addRule(rule); err != nil {
+			return fmt.Errorf("agg: loading rules: %w", err)
+		}
+		// keep the stored version, and carry on from
+		// there, so that versions keep increasing
+		if version != 0 {
+			r := h.rules[rule.Stream]
+			r.Version = version
+			h.rules[rule.Stream] = r
+		}
+		if version > h.revision {
+			h.revision = version
+		}
+	}
+
+	// versions given to rules since deleted are not given again
+	if revision > h.revision {
+		h.revision = revision
+	}
+
+	return nil
+}
+
+// persist saves the rules after a change, unless the change failed.
+// A change that cannot be saved is still in effect.
+func (h *Hub) persist(err error) error {
+
+	if err != nil || h.Store == nil {
+		return err
+	}
+
+	if err := h.Store.Save(h.ruleList(), h.revision); err != nil {
+		return fmt.Errorf("agg: rule applied but not saved: %w", err)
+	}
+
+	return nil
+}
+
+// ruleList returns copies of the rules, sorted by stream
+func (h *Hub) ruleList() []Rule {
+
+	rules := []Rule{}
+
+	// rules set by a schedule are saved as they are outside it
+	for stream := range h.rules {
+		if rule, ok := h.baseRule(stream); ok {
+			rules = append(rules, rule.copy())
+		}
+	}
+
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Stream < rules[j].Stream })
+
+	return rules
+}
@@ -0,0 +1,141 @@
+package agg
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+
+	dir := t.TempDir()
+	store := NewFileStore(filepath.Join(dir, "rules.json"))
+
+	rules, revision, err := store.Load()
+	if err != nil || len(rules) != 0 || revision != 0 {
+		t.Fatal("wanted no rules from missing file, got", rules, revision, err)
+	}
+
+	want := []Rule{
+		{Stream: "stream/large", Feeds: []string{"video0", "audio"}},
+		{Stream: "stream/small", Feeds: []string{"video1"}, Policy: &RelayPolicy{Mode: RelayDropOldest, Size: 4}},
+	}
+
+	if err := store.Save(want, 7); err != nil {
+		t.Fatal(err)
+	}
+
+	got, revision, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) || revision != 7 {
+		t.Error("wanted", want, "at revision 7, got", got, revision)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Error("temporary files left behind", entries)
+	}
+
+	// a file from before the revision was saved is just the rules
+	legacy := `[{"stream": "stream/large", "feeds": ["video0", "audio"], "version": 3}]`
+	if err := os.WriteFile(store.Path, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, revision, err = store.Load()
+	if err != nil || len(got) != 1 || got[0].Version != 3 || revision != 0 {
+		t.Error("wanted the listed rule, got", got, revision, err)
+	}
+}
+
+func TestHubRulesSurviveRestart(t *testing.T) {
+
+	store := NewFileStore(filepath.Join(t.TempDir(), "rules.json"))
+	rule := Rule{Stream: "stream/large", Feeds: []string{"video0", "audio"}}
+
+	h := New()
+	h.Store = store
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() {
+		stopped <- h.RunContext(ctx)
+	}()
+
+	if err := h.AddRule(ctx, rule); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AddRule(ctx, Rule{Stream: "stream/gone", Feeds: []string{"video1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.DeleteRule(ctx, "stream/gone"); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+
+	h = New()
+	h.Store = store
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	s, err := h.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the rule keeps the version it had when it was saved
+	rule.Version = 1
+	if len(s.Rules) != 1 || !reflect.DeepEqual(s.Rules[rule.Stream], rule) {
+		t.Error("wanted rule reloaded, got", s.Rules)
+	}
+
+	// the deleted rule's version is not given again
+	version, err := h.AddRuleIf(ctx, Rule{Stream: "stream/gone", Feeds: []string{"video1"}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version <= 2 {
+		t.Error("wanted a version above 2, got", version)
+	}
+	if err := h.DeleteRuleIf(ctx, "stream/gone", 2); !errors.Is(err, ErrVersion) {
+		t.Error("wanted ErrVersion for the old version, got", err)
+	}
+}
+
+type failingStore struct{}
+
+func (failingStore) Load() ([]Rule, uint64, error) { return nil, 0, errors.New("disk on fire") }
+func (failingStore) Save([]Rule, uint64) error     { return errors.New("disk on fire") }
+
+func TestHubStoreErrors(t *testing.T) {
+
+	h := New()
+	h.Store = failingStore{}
+	if err := h.RunContext(context.Background()); err == nil {
+		t.Error("wanted error when rules cannot be loaded")
+	}
+
+	// the legacy entry points return nothing, so the cause is kept
+	h = New()
+	h.Store = failingStore{}
+	h.Run(make(chan struct{}))
+
+	if h.Err() == nil {
+		t.Error("wanted Err to give the cause")
+	}
+
+	err := h.AddRule(context.Background(), Rule{Stream: "stream/large", Feeds: []string{"video0"}})
+	if !errors.Is(err, ErrHubClosed) || !errors.Is(err, h.Err()) {
+		t.Error("wanted ErrHubClosed with the cause, got", err)
+	}
+}
@@ -0,0 +1,31 @@
+package agg
+
+import "github.com/timdrysdale/hub"
+
+// TaggedMessage is a message relayed to a stream client, labelled with
+// the feed it came from and the stream it was relayed for, so that a
+// destination can tell its feeds apart without relying on the sender.
+// A feed that is in more than one of a client's streams is relayed
+// once, for the first of those streams by name.
+type TaggedMessage struct {
+	Stream  string
+	Feed    string
+	Message hub.Message
+}
+
+// sendTo returns the channel a relay sends plain messages on, which is
+// nil if the client takes tagged messages instead. Sending on a nil
+// channel never proceeds, so a relay can offer a message on both and
+// only the one in use is taken.
+func (sc *SubClient) sendTo(c *hub.Client) chan hub.Message {
+
+	if sc.tagged != nil {
+		return nil
+	}
+
+	return c.Send
+}
+
+func (sc *SubClient) tag(msg hub.Message) TaggedMessage {
+	return TaggedMessage{Stream: sc.stream, Feed: sc.Client.Topic, Message: msg}
+}
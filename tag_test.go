@@ -0,0 +1,63 @@
+package agg
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/timdrysdale/hub"
+)
+
+func TestTaggedMessages(t *testing.T) {
+
+	for _, policy := range []*RelayPolicy{nil, {Mode: RelayDropOldest}, {Mode: RelayDisconnect}} {
+
+		h := New()
+		ctx, cancel := context.WithCancel(context.Background())
+		go h.RunContext(ctx)
+
+		stream := "stream/large"
+		if err := h.AddRule(ctx, Rule{Stream: stream, Feeds: []string{"video0", "audio"}}); err != nil {
+			t.Fatal(err)
+		}
+
+		tagged := make(chan TaggedMessage)
+		c := &hub.Client{Hub: h.Hub, Name: "aa", Topic: stream, Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+		if err := h.RegisterWithOptions(ctx, c, ClientOptions{Policy: policy, Tagged: tagged}); err != nil {
+			t.Fatal(err)
+		}
+
+		// the senders have the same name, so only the tag tells them apart
+		c1 := &hub.Client{Hub: h.Hub, Name: "cam", Topic: "video0", Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+		c2 := &hub.Client{Hub: h.Hub, Name: "cam", Topic: "audio", Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+		h.Register <- c1
+		h.Register <- c2
+
+		time.Sleep(time.Millisecond)
+		h.Broadcast <- hub.Message{Data: []byte("v"), Sender: *c1, Sent: time.Now()}
+		h.Broadcast <- hub.Message{Data: []byte("a"), Sender: *c2, Sent: time.Now()}
+
+		got := []string{}
+		for len(got) < 2 {
+			select {
+			case m := <-tagged:
+				if m.Stream != stream {
+					t.Error("wrong stream in tag", m.Stream)
+				}
+				got = append(got, m.Feed+":"+string(m.Message.Data))
+			case <-c.Send:
+				t.Error("untagged message delivered")
+			case <-time.After(time.Second):
+				t.Fatal("tagged messages not delivered, got", got)
+			}
+		}
+
+		sort.Strings(got)
+		if got[0] != "audio:a" || got[1] != "video0:v" {
+			t.Error("wrong tags", got)
+		}
+
+		cancel()
+	}
+}
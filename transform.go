@@ -0,0 +1,176 @@
+package agg
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/timdrysdale/hub"
+)
+
+var ErrInvalidTransform = errors.New("transform is not registered, or its params are invalid")
+
+// Transform changes a message on its way to a stream client. It may
+// return any number of messages in its place, including none. The
+// message data is shared with the other subscribers to the feed, so it
+// must be copied, not changed in place.
+type Transform interface {
+	Transform(msg hub.Message) ([]hub.Message, error)
+}
+
+// TransformFunc lets a function with no state be used as a Transform
+type TransformFunc func(msg hub.Message) ([]hub.Message, error)
+
+func (f TransformFunc) Transform(msg hub.Message) ([]hub.Message, error) {
+	return f(msg)
+}
+
+// NewTransform makes a Transform for a relay, from the params in a rule
+type NewTransform func(params map[string]string) (Transform, error)
+
+// TransformConfig names a registered transform, with its params
+type TransformConfig struct {
+	Name   string            `json:"name"`
+	Params map[string]string `json:"params,omitempty"`
+}
+
+var (
+	transformsMu sync.RWMutex
+	transforms   = make(map[string]NewTransform)
+)
+
+// RegisterTransform makes a transform available to rules by name,
+// replacing any already registered with that name. Relays that are
+// already running keep the transforms they started with.
+func RegisterTransform(name string, f NewTransform) {
+
+	if f == nil {
+		panic("agg: RegisterTransform with nil function")
+	}
+
+	transformsMu.Lock()
+	defer transformsMu.Unlock()
+
+	transforms[name] = f
+}
+
+// newTransform makes a transform from its config
+func newTransform(config TransformConfig) (Transform, error) {
+
+	transformsMu.RLock()
+	f, ok := transforms[config.Name]
+	transformsMu.RUnlock()
+
+	if !ok {
+		return nil, ErrInvalidTransform
+	}
+
+	t, err := f(config.Params)
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (config TransformConfig) validate() error {
+
+	if _, err := newTransform(config); err != nil {
+		return ErrInvalidTransform
+	}
+
+	return nil
+}
+
+// copy returns a config that shares no memory with c
+func (c TransformConfig) copy() TransformConfig {
+
+	if c.Params == nil {
+		return c
+	}
+
+	params := make(map[string]string)
+	for k, v := range c.Params {
+		params[k] = v
+	}
+	c.Params = params
+
+	return c
+}
+
+// transformsFor returns the transforms of a rule that apply to a topic
+func transformsFor(rule Rule, topic string) []TransformConfig {
+
+	keys := []string{}
+	for key := range rule.Transforms {
+		if key == topic || (isPattern(key) && matchFeed(key, topic)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	configs := []TransformConfig{}
+	for _, key := range keys {
+		configs = append(configs, rule.Transforms[key]...)
+	}
+
+	return configs
+}
+
+// failedTransform stands in for a transform that could not be made,
+// e.g. because it was registered again with different params checks
+type failedTransform struct {
+	err error
+}
+
+func (f failedTransform) Transform(hub.Message) ([]hub.Message, error) {
+	return nil, f.err
+}
+
+// setTransforms gives a subclient its own instance of each transform
+func (sc *SubClient) setTransforms(configs []TransformConfig) {
+
+	sc.transformConfigs = configs
+	sc.transforms = nil
+
+	for _, config := range configs {
+		t, err := newTransform(config)
+		if err != nil {
+			t = failedTransform{err: err}
+		}
+		sc.transforms = append(sc.transforms, t)
+	}
+}
+
+// transform passes a message through each of the subclient's
+// transforms in turn, counting any errors
+func (sc *SubClient) transform(msg hub.Message) []hub.Message {
+
+	msgs := []hub.Message{msg}
+
+	for _, t := range sc.transforms {
+		next := []hub.Message{}
+		for _, msg := range msgs {
+			out, err := t.Transform(msg)
+			if err != nil {
+				sc.transformError()
+				continue
+			}
+			next = append(next, out...)
+		}
+		msgs = next
+	}
+
+	return msgs
+}
+
+// transformError records a message lost to a failed transform
+func (sc *SubClient) transformError() {
+
+	for _, c := range []*relayCounters{sc.counters, sc.feedCounters} {
+		if c != nil {
+			atomic.AddUint64(&c.errors, 1)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package agg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/timdrysdale/hub"
+)
+
+// chunks splits messages into parts of up to "size" bytes, failing
+// on empty messages
+func chunks(params map[string]string) (Transform, error) {
+
+	size, err := strconv.Atoi(params["size"])
+	if err != nil || size < 1 {
+		return nil, errors.New("size must be a positive number")
+	}
+
+	return TransformFunc(func(msg hub.Message) ([]hub.Message, error) {
+		if len(msg.Data) == 0 {
+			return nil, errors.New("empty message")
+		}
+		msgs := []hub.Message{}
+		for data := msg.Data; len(data) > 0; {
+			n := size
+			if n > len(data) {
+				n = len(data)
+			}
+			part := msg
+			part.Data = data[:n]
+			msgs = append(msgs, part)
+			data = data[n:]
+		}
+		return msgs, nil
+	}), nil
+}
+
+func upper(map[string]string) (Transform, error) {
+	return TransformFunc(func(msg hub.Message) ([]hub.Message, error) {
+		msg.Data = bytes.ToUpper(msg.Data)
+		return []hub.Message{msg}, nil
+	}), nil
+}
+
+func TestInvalidTransform(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	RegisterTransform("chunks", chunks)
+
+	for _, config := range []TransformConfig{{Name: "unregistered"}, {Name: "chunks"}, {Name: "chunks", Params: map[string]string{"size": "0"}}} {
+		rule := Rule{Stream: "stream/data", Feeds: []string{"data"}, Transforms: map[string][]TransformConfig{"data": {config}}}
+		if err := h.AddRule(ctx, rule); !errors.Is(err, ErrInvalidTransform) {
+			t.Error("wanted ErrInvalidTransform, got", err)
+		}
+	}
+}
+
+func TestRuleTransforms(t *testing.T) {
+	h := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.RunContext(ctx)
+
+	RegisterTransform("chunks", chunks)
+	RegisterTransform("upper", upper)
+
+	stream := "stream/data"
+	rule := Rule{
+		Stream: stream,
+		Feeds:  []string{"data"},
+		Transforms: map[string][]TransformConfig{
+			"**":   {{Name: "upper"}},
+			"data": {{Name: "chunks", Params: map[string]string{"size": "3"}}},
+		},
+	}
+	if err := h.AddRule(ctx, rule); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &hub.Client{Hub: h.Hub, Name: "aa", Topic: stream, Send: make(chan hub.Message, 8), Stats: hub.NewClientStats()}
+	if err := h.RegisterWithOptions(ctx, c, ClientOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	c1 := &hub.Client{Hub: h.Hub, Name: "1", Topic: "data", Send: make(chan hub.Message), Stats: hub.NewClientStats()}
+	h.Register <- c1
+	time.Sleep(time.Millisecond)
+
+	data := []byte("hello")
+	for _, msg := range []hub.Message{{Data: []byte{}}, {Data: data}} {
+		msg.Sender = *c1
+		h.Broadcast <- msg
+		// the hub drops subclients that are not ready for the next message
+		time.Sleep(time.Millisecond)
+	}
+
+	// "**" sorts before "data", so the chunks are made after upper
+	for _, want := range []string{"HEL", "LO"} {
+		select {
+		case msg := <-c.Send:
+			if string(msg.Data) != want {
+				t.Error("wanted", want, "got", string(msg.Data))
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no message")
+		}
+	}
+
+	if string(data) != "hello" {
+		t.Error("transform changed the broadcast message", string(data))
+	}
+
+	stats, err := h.StreamStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stats[stream].Feeds["data"]; got.Errors != 1 || got.Messages != 2 {
+		t.Error("wanted one error and two messages, got", got)
+	}
+}
@@ -1,6 +1,8 @@
 package agg
 
 import (
+	"sync"
+
 	"github.com/timdrysdale/hub"
 )
 
@@ -14,14 +16,106 @@ type Hub struct {
 	Rules      map[string][]string
 	Streams    map[string]map[*hub.Client]bool
 	SubClients map[*hub.Client]map[*SubClient]bool
+	Store      RuleStore
+	Clock      Clock
+
+	// rules holds the full rule for each stream; Rules is
+	// kept in step with it for compatibility
+	rules    map[string]Rule
+	options  map[*hub.Client]ClientOptions
+	counters map[*hub.Client]*relayCounters
+	// feeds holds the clients registered directly to each topic
+	feeds map[string]map[*hub.Client]bool
+	// joined counts the registrations of each client to each stream
+	joined map[*hub.Client]map[string]int
+	muxers map[*hub.Client]*muxer
+	// relaying holds the subclients registered to each topic
+	relaying map[string]map[*SubClient]bool
+	// limiters holds the token buckets of each client, by limit
+	limiters map[*hub.Client]map[RateLimit]*limiter
+	// replays holds the cache of each feed of each stream, and
+	// replayIndex the caches of each feed, or nil if out of date
+	replays     map[string]map[string]*replayCache
+	replayIndex map[string][]*replayCache
+	// joining, while a client joins a stream, holds the topics
+	// it had already, which are not replayed
+	joining map[string]bool
+	// feedCounters holds the counters for each feed of each stream
+	feedCounters map[string]map[string]*relayCounters
+	subscribers  map[*subscriber]bool
+	mutes        map[string]map[string]*mute
+	schedules    map[string]Schedule
+	// overrides holds the streams whose rule is set by a schedule
+	overrides     map[string]*override
+	scheduleTimer Timer
+	// revision is the version given to the last rule changed
+	revision uint64
+	// err is why the hub stopped, if it could not start
+	err error
+
+	ruleRequests     chan ruleRequest
+	registerRequests chan registerRequest
+	snapshotRequests chan snapshotRequest
+	statsRequests    chan statsRequest
+	subscriptions    chan subscribeRequest
+	muteRequests     chan muteRequest
+	muteExpiries     chan muteExpiry
+	scheduleRequests chan scheduleRequest
+	scheduleTicks    chan struct{}
+	evictions        chan eviction
+	done             chan struct{}
+	relays           sync.WaitGroup
+	// running counts relay goroutines, and is updated atomically
+	running *int64
 }
 
 type Rule struct {
-	Stream string   `json:"stream"`
-	Feeds  []string `json:"feeds"`
+	Stream string       `json:"stream"`
+	Feeds  []string     `json:"feeds"`
+	Policy *RelayPolicy `json:"policy,omitempty"`
+	Return []string     `json:"return,omitempty"`
+	// Version is set by the hub each time the rule is changed
+	Version uint64 `json:"version,omitempty"`
+	// Mux combines MPEG-TS feeds into one transport stream
+	Mux bool `json:"mux,omitempty"`
+	// Filters limit the messages relayed from each feed or pattern
+	Filters map[string]Filter `json:"filters,omitempty"`
+	// Transforms change the messages relayed from each feed or pattern
+	Transforms map[string][]TransformConfig `json:"transforms,omitempty"`
+	// Limit slows the messages relayed to each client of the stream
+	Limit *RateLimit `json:"limit,omitempty"`
+	// Replay sends the recent messages of each feed to new clients
+	Replay *Replay `json:"replay,omitempty"`
 }
 
 type SubClient struct {
 	Client  *hub.Client
 	Stopped chan struct{}
+	Policy  RelayPolicy
+
+	// stream is the stream the feed is counted against
+	stream string
+	// tagged, if set, takes the messages instead of the client's Send
+	tagged      chan<- TaggedMessage
+	mux         *muxer
+	filters     []Filter
+	filterFuncs []FilterFunc
+	// transformConfigs are kept to tell if the rule has changed
+	transformConfigs []TransformConfig
+	transforms       []Transform
+	limit            RateLimit
+	limiter          *limiter
+	// skipped counts the messages since the last kept by decimation
+	skipped int
+	// replay is sent before the messages from the feed
+	replay []hub.Message
+	// offered counts the messages the inner hub was given for the
+	// subclient, and received those the relay took, so that the rest
+	// can be counted as dropped if the inner hub drops the subclient
+	offered      uint64
+	received     uint64
+	counters     *relayCounters
+	feedCounters *relayCounters
+	evict        chan<- eviction
+	exited       chan struct{}
 }